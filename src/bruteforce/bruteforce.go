@@ -22,6 +22,7 @@ package bruteforce
 import (
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"marcellozaniboni.net/httpiccolo/mutils"
@@ -40,7 +41,10 @@ type failedAccess struct {
 	accessTime time.Time
 }
 
-var accessLog = map[string]failedAccess{} // TODO: this should sync.Map!!!
+var accessLog = map[string]failedAccess{}
+
+// accessLogMutex guards accessLog, since logins are concurrent
+var accessLogMutex sync.Mutex
 
 // RecordFailedLogin records a failed login in memory; call it
 // when a login fails passing the IP.
@@ -51,11 +55,14 @@ func RecordFailedLogin(ip string) {
 	fa.ip = ip
 	fa.accessTime = time.Now()
 	randomKey := mutils.RandomId(randomKeyLength)
+	accessLogMutex.Lock()
 	accessLog[randomKey] = fa
+	accessLogMutex.Unlock()
 }
 
 // cleanOldAccessLogs cleans the failed login logs older
 // than maxLoginsMinutes; only useful logs are kept.
+// The caller must hold accessLogMutex.
 func cleanOldAccessLogs() {
 	for k, v := range accessLog {
 		if v.accessTime.Before(time.Now().Add(-time.Duration(maxLoginsMinutes) * time.Minute)) {
@@ -67,6 +74,8 @@ func cleanOldAccessLogs() {
 // Banned returns the ban status for an IP address: true
 // means that the IP is banned.
 func Banned(ip string) bool {
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
 	cleanOldAccessLogs()
 	var failCount int64 = 0
 	for _, v := range accessLog {
@@ -80,6 +89,8 @@ func Banned(ip string) bool {
 // PrintAccessLog does pretty logging (for development purposes).
 // It returns a formatted, printable string.
 func PrintAccessLog() string {
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
 	info := fmt.Sprintln("number of failed login in the last "+strconv.Itoa(maxLoginsMinutes)+" minutes:", len(accessLog))
 	for key, al := range accessLog {
 		info += fmt.Sprintln("\tkey =", key)
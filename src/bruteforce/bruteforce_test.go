@@ -0,0 +1,60 @@
+package bruteforce
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentFailedLogins(t *testing.T) {
+	const clients = 20
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		ip := "192.0.2." + strconv.Itoa(i+1)
+		// the even clients reach the limit, the odd ones stay below it
+		fails := maxLoginFails
+		if i%2 == 1 {
+			fails = maxLoginFails - 1
+		}
+		for j := 0; j < fails; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				RecordFailedLogin(ip)
+				Banned(ip)
+			}()
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		PrintAccessLog()
+	}()
+	wg.Wait()
+
+	for i := 0; i < clients; i++ {
+		ip := "192.0.2." + strconv.Itoa(i+1)
+		if expected := i%2 == 0; Banned(ip) != expected {
+			t.Errorf("Banned(%q) = %v, expected %v", ip, !expected, expected)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/term"
+	"marcellozaniboni.net/httpiccolo/mdao"
+	"marcellozaniboni.net/httpiccolo/mutils"
+)
+
+// commandsUsage is appended to the help of the command line
+const commandsUsage string = `
+Commands:
+  init    create the configuration without questions, reading the values
+          from the options or from HTTPICCOLO_* environment variables
+          (run "httpiccolo init -h" for details)
+  user    manage the users of an existing configuration:
+            user add [-password-file file] <username>
+            user passwd [-password-file file] <username>
+            user delete <username>
+            user list
+          the password is asked on the terminal, or it is read from the
+          first line of the file ("-" is the standard input)
+  perm    manage the permissions of the directories:
+            perm add [-read users] [-write users] <directory>
+            perm set [-read users] [-write users] <directory>
+            perm delete <directory>
+            perm list
+          users are comma separated; add fails if the directory already
+          has permissions, set creates or replaces them
+  config  read or change the general parameters:
+            config get [name]
+            config set <name> <value>
+
+The commands change the json files in the configuration directory
+(use -c before the command to choose it); a running server applies the
+changes after a SIGHUP, or by itself when config_watch_seconds is set.
+
+Without a command, the server starts; if the configuration directory
+does not exist, the configuration wizard asks a few questions.`
+
+// runCommand runs a command given on the command line. Commands print
+// the errors on the standard error and exit with status 1, without the
+// pauses of the interactive mode.
+func runCommand(userDefinedDirectory string, args []string) {
+	switch args[0] {
+	case "init":
+		commandInit(userDefinedDirectory, args[1:])
+	case "user":
+		commandUser(userDefinedDirectory, args[1:])
+	case "perm":
+		commandPerm(userDefinedDirectory, args[1:])
+	case "config":
+		commandConfig(userDefinedDirectory, args[1:])
+	default:
+		commandFailed(errors.New("unknown command \"" + args[0] + "\", run \"httpiccolo -h\" for help"))
+	}
+}
+
+// commandFailed prints an error and exits with status 1.
+func commandFailed(err error) {
+	fmt.Fprintln(os.Stderr, "error: "+err.Error())
+	os.Exit(1)
+}
+
+// commandInit creates a new configuration like the wizard does, but
+// reads the values from the options or from environment variables, so
+// that it can run in containers and service units.
+func commandInit(userDefinedDirectory string, args []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	configDir := flags.String("c", envDefault("HTTPICCOLO_CONFIG_DIR", userDefinedDirectory), "configuration directory (HTTPICCOLO_CONFIG_DIR);\nit must not exist, or it must be empty")
+	adminUser := flags.String("admin-user", envDefault("HTTPICCOLO_ADMIN_USER", ""), "administrator username (HTTPICCOLO_ADMIN_USER)")
+	passwordFile := flags.String("admin-password-file", envDefault("HTTPICCOLO_ADMIN_PASSWORD_FILE", ""), "file containing the administrator password, at least 5\ncharacters long; \"-\" reads it from the standard input\n(HTTPICCOLO_ADMIN_PASSWORD_FILE)")
+	port := flags.String("port", envDefault("HTTPICCOLO_PORT", ""), "HTTP port number (HTTPICCOLO_PORT)")
+	rootDirectory := flags.String("root", envDefault("HTTPICCOLO_ROOT_DIRECTORY", ""), "root directory of the published contents (HTTPICCOLO_ROOT_DIRECTORY)")
+	tlsHosts := flags.String("tls-hosts", envDefault("HTTPICCOLO_TLS_HOSTS", ""), "optional: comma separated host names and IP addresses;\nwhen defined, a self-signed certificate is generated\nand HTTPS is enabled (HTTPICCOLO_TLS_HOSTS)")
+	keepExisting := flags.Bool("keep-existing", envDefault("HTTPICCOLO_KEEP_EXISTING", "") == "true", "exit with status 0 if the configuration already exists,\ninstead of failing (HTTPICCOLO_KEEP_EXISTING=true)")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		commandFailed(errors.New("unexpected argument \"" + flags.Arg(0) + "\""))
+	}
+
+	directory := configurationDirectory(*configDir)
+	if _, err := os.Stat(directory + "/params.json"); err == nil {
+		if *keepExisting {
+			fmt.Println("configuration already present in \"" + directory + "\", nothing to do")
+			return
+		}
+		commandFailed(errors.New("the configuration already exists in \"" + directory + "\""))
+	}
+
+	// the same checks as the wizard
+	if err := checkAdminUsername(*adminUser); err != nil {
+		commandFailed(err)
+	}
+	if *passwordFile == "" {
+		commandFailed(errors.New("the administrator password file is not defined"))
+	}
+	password, err := readPasswordFile(*passwordFile)
+	if err != nil {
+		commandFailed(err)
+	}
+	if err := checkAdminPassword(password); err != nil {
+		commandFailed(err)
+	}
+	portNumber, err := mdao.ParsePort(*port)
+	if err != nil {
+		commandFailed(err)
+	}
+	root, err := checkRootDirectory(*rootDirectory)
+	if err != nil {
+		commandFailed(err)
+	}
+	var certificateHosts []string
+	if *tlsHosts != "" {
+		certificateHosts, err = parseCertificateHosts(*tlsHosts)
+		if err != nil {
+			commandFailed(err)
+		}
+	}
+
+	// an existing empty directory is fine (e.g. a mounted volume)
+	if err := os.MkdirAll(directory, 0750); err != nil {
+		commandFailed(err)
+	}
+	if entries, err := os.ReadDir(directory); err != nil {
+		commandFailed(err)
+	} else if len(entries) > 0 {
+		commandFailed(errors.New("the directory \"" + directory + "\" is not empty"))
+	}
+	if err := saveNewConfiguration(directory, *adminUser, password, portNumber, root, certificateHosts); err != nil {
+		commandFailed(err)
+	}
+	fmt.Println("configuration saved in \"" + directory + "\"")
+}
+
+// envDefault returns the value of an environment variable, or def if
+// it is not defined.
+func envDefault(name string, def string) string {
+	if value, found := os.LookupEnv(name); found {
+		return value
+	}
+	return def
+}
+
+// readPasswordFile returns the first line of a file, or of the standard
+// input when filename is "-".
+func readPasswordFile(filename string) (string, error) {
+	file := os.Stdin
+	if filename != "-" {
+		var err error
+		file, err = os.Open(filename)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+	}
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("cannot read the administrator password: " + err.Error())
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// existingConfigurationDirectory returns the configuration directory of
+// the user, perm and config commands; it must contain a configuration.
+func existingConfigurationDirectory(userDefinedDirectory string) string {
+	directory := configurationDirectory(userDefinedDirectory)
+	if _, err := os.Stat(directory + "/params.json"); err != nil {
+		commandFailed(errors.New("no configuration found in \"" + directory + "\"; use -c, or create it with \"httpiccolo init\""))
+	}
+	return directory
+}
+
+// commandArguments checks the number of the arguments of a subcommand.
+func commandArguments(args []string, count int, usage string) {
+	if len(args) != count {
+		commandFailed(errors.New("usage: httpiccolo " + usage))
+	}
+}
+
+// commandUser adds, changes, deletes and lists the users.
+func commandUser(userDefinedDirectory string, args []string) {
+	if len(args) == 0 {
+		commandFailed(errors.New("missing subcommand: user add, passwd, delete or list"))
+	}
+	directory := existingConfigurationDirectory(userDefinedDirectory)
+	users, err := mdao.LoadUsers(directory)
+	if err != nil {
+		commandFailed(err)
+	}
+
+	switch args[0] {
+	case "add", "passwd":
+		flags := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+		passwordFile := flags.String("password-file", "-", "file containing the password; \"-\" asks it on the\nterminal, or reads it from the standard input")
+		flags.Parse(args[1:])
+		commandArguments(flags.Args(), 1, "user "+args[0]+" [-password-file file] <username>")
+		username := flags.Arg(0)
+		_, found := users[username]
+		if args[0] == "add" {
+			if found {
+				commandFailed(errors.New("the user \"" + username + "\" already exists, use \"user passwd\" to change the password"))
+			}
+			if err := checkUsername(username); err != nil {
+				commandFailed(err)
+			}
+		} else if !found {
+			commandFailed(errors.New("the user \"" + username + "\" does not exist"))
+		}
+		password, err := readNewPassword(*passwordFile)
+		if err != nil {
+			commandFailed(err)
+		}
+		if err := checkAdminPassword(password); err != nil {
+			commandFailed(err)
+		}
+		users[username] = mutils.HashPassword(password)
+		mdao.WriteUsersJson(directory, users)
+		if args[0] == "add" {
+			fmt.Println("user \"" + username + "\" added")
+		} else {
+			fmt.Println("password of the user \"" + username + "\" changed")
+		}
+	case "delete":
+		commandArguments(args[1:], 1, "user delete <username>")
+		username := args[1]
+		if _, found := users[username]; !found {
+			commandFailed(errors.New("the user \"" + username + "\" does not exist"))
+		}
+		tokens, err := mdao.LoadTokens(directory)
+		if err != nil {
+			commandFailed(err)
+		}
+		delete(users, username)
+		mdao.WriteUsersJson(directory, users)
+		// revoke the API tokens of the user, like the web console does
+		s := &appState{tokens: tokens}
+		if revokeUserTokens(s, username) > 0 {
+			mdao.WriteTokensJson(directory, s.tokens)
+		}
+		fmt.Println("user \"" + username + "\" deleted")
+	case "list":
+		commandArguments(args[1:], 0, "user list")
+		configuration, err := mdao.ParseGeneralParameters(directory)
+		if err != nil {
+			commandFailed(err)
+		}
+		administrators := strings.Split(configuration["admin_users"], ",")
+		usernames := make([]string, 0, len(users))
+		for u := range users {
+			usernames = append(usernames, u)
+		}
+		sort.Strings(usernames)
+		for _, u := range usernames {
+			line := u + "\t" + mutils.PasswordScheme(users[u])
+			for _, administrator := range administrators {
+				if administrator == u {
+					line += "\tadmin"
+					break
+				}
+			}
+			fmt.Println(line)
+		}
+	default:
+		commandFailed(errors.New("unknown subcommand \"user " + args[0] + "\""))
+	}
+}
+
+// checkUsername validates a new username: user lists are comma
+// separated, so commas and spaces are not allowed.
+func checkUsername(username string) error {
+	if err := checkAdminUsername(username); err != nil {
+		return err
+	}
+	if strings.ContainsAny(username, ", \t") {
+		return errors.New("the username cannot contain commas or spaces")
+	}
+	return nil
+}
+
+// readNewPassword asks the password on the terminal, or reads it from
+// a file or from the standard input.
+func readNewPassword(filename string) (string, error) {
+	if filename != "-" || !term.IsTerminal(int(syscall.Stdin)) {
+		return readPasswordFile(filename)
+	}
+	fmt.Print("Password (at least 5 characters long)? ")
+	bytepassword, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("Password again? ")
+	confirmation, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if string(bytepassword) != string(confirmation) {
+		return "", errors.New("the passwords do not match")
+	}
+	return string(bytepassword), nil
+}
+
+// commandPerm adds, changes, deletes and lists the permissions.
+func commandPerm(userDefinedDirectory string, args []string) {
+	if len(args) == 0 {
+		commandFailed(errors.New("missing subcommand: perm add, set, delete or list"))
+	}
+	directory := existingConfigurationDirectory(userDefinedDirectory)
+	permissions, writePermissions, err := mdao.LoadPermissions(directory)
+	if err != nil {
+		commandFailed(err)
+	}
+	s := &appState{permissions: permissions, writePermissions: writePermissions}
+
+	switch args[0] {
+	case "add", "set":
+		flags := flag.NewFlagSet("perm "+args[0], flag.ExitOnError)
+		readUsers := flags.String("read", "", "comma separated users allowed to read the directory")
+		writeUsers := flags.String("write", "", "comma separated users allowed to write the directory")
+		flags.Parse(args[1:])
+		commandArguments(flags.Args(), 1, "perm "+args[0]+" [-read users] [-write users] <directory>")
+		path := permissionPath(flags.Arg(0))
+		_, readFound := permissions[path]
+		_, writeFound := writePermissions[path]
+		if args[0] == "add" && (readFound || writeFound) {
+			commandFailed(errors.New("the directory \"" + path + "\" already has permissions, use \"perm set\" to replace them"))
+		}
+		configuration, err := mdao.ParseGeneralParameters(directory)
+		if err != nil {
+			commandFailed(err)
+		}
+		if finfo, err := os.Stat(configuration["root_directory"] + path); err != nil || !finfo.IsDir() {
+			commandFailed(errors.New("the directory \"" + path + "\" does not exist in the root directory"))
+		}
+		users, err := mdao.LoadUsers(directory)
+		if err != nil {
+			commandFailed(err)
+		}
+		ulist, err := userList(*readUsers, users)
+		if err != nil {
+			commandFailed(err)
+		}
+		wlist, err := userList(*writeUsers, users)
+		if err != nil {
+			commandFailed(err)
+		}
+		if ulist == "" && wlist == "" {
+			commandFailed(errors.New("define the users with -read and/or -write; use \"perm delete\" to remove the permissions"))
+		}
+		setPermission(s, path, ulist, wlist)
+		mdao.WritePermissionsJson(directory, s.permissions, s.writePermissions)
+		fmt.Println("permissions of \"" + path + "\" saved")
+	case "delete":
+		commandArguments(args[1:], 1, "perm delete <directory>")
+		path := permissionPath(args[1])
+		_, readFound := permissions[path]
+		_, writeFound := writePermissions[path]
+		if !readFound && !writeFound {
+			commandFailed(errors.New("the directory \"" + path + "\" has no permissions"))
+		}
+		setPermission(s, path, "", "")
+		mdao.WritePermissionsJson(directory, s.permissions, s.writePermissions)
+		fmt.Println("permissions of \"" + path + "\" deleted")
+	case "list":
+		commandArguments(args[1:], 0, "perm list")
+		var paths []string
+		for p := range permissions {
+			paths = append(paths, p)
+		}
+		for p := range writePermissions {
+			if _, found := permissions[p]; !found {
+				paths = append(paths, p)
+			}
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			ulist, wlist := permissions[p], writePermissions[p]
+			if ulist == "" {
+				ulist = "-"
+			}
+			if wlist == "" {
+				wlist = "-"
+			}
+			fmt.Println(p + "\tread=" + ulist + "\twrite=" + wlist)
+		}
+	default:
+		commandFailed(errors.New("unknown subcommand \"perm " + args[0] + "\""))
+	}
+}
+
+// permissionPath returns a directory in the format of permissions.json,
+// i.e. relative to the root directory, with a leading slash and without
+// the trailing one.
+func permissionPath(directory string) string {
+	path := "/" + strings.Trim(mutils.BackToForwardSlashes(directory), "/")
+	if path == "/" {
+		commandFailed(errors.New("the root directory cannot have permissions"))
+	}
+	return path
+}
+
+// userList normalizes a comma separated list of users, which must exist.
+func userList(list string, users map[string]string) (string, error) {
+	var names []string
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if _, found := users[u]; !found {
+			return "", errors.New("the user \"" + u + "\" does not exist")
+		}
+		names = append(names, u)
+	}
+	return strings.Join(names, ","), nil
+}
+
+// commandConfig reads and changes the general parameters.
+func commandConfig(userDefinedDirectory string, args []string) {
+	if len(args) == 0 {
+		commandFailed(errors.New("missing subcommand: config get or set"))
+	}
+	directory := existingConfigurationDirectory(userDefinedDirectory)
+	// not validated, so that a wrong value can be fixed
+	configuration, err := mdao.ParseGeneralParameters(directory)
+	if err != nil {
+		commandFailed(err)
+	}
+
+	switch args[0] {
+	case "get":
+		if len(args) > 2 {
+			commandFailed(errors.New("usage: httpiccolo config get [name]"))
+		}
+		if len(args) == 2 {
+			value, found := configuration[args[1]]
+			if !found {
+				commandFailed(errors.New("the parameter \"" + args[1] + "\" is not defined"))
+			}
+			fmt.Println(value)
+			return
+		}
+		names := make([]string, 0, len(configuration))
+		for name := range configuration {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name + "=" + configuration[name])
+		}
+	case "set":
+		commandArguments(args[1:], 2, "config set <name> <value>")
+		name, value := args[1], args[2]
+		known := false
+		for _, n := range mdao.GeneralParameterNames {
+			if n == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			commandFailed(errors.New("unknown parameter \"" + name + "\"; the parameters are: " + strings.Join(mdao.GeneralParameterNames, ", ")))
+		}
+		// an empty value removes an optional parameter
+		if value == "" {
+			delete(configuration, name)
+		} else {
+			configuration[name] = value
+		}
+		if err := mdao.ValidateGeneralParameters(configuration); err != nil {
+			commandFailed(errors.New("the configuration has not been saved: " + err.Error()))
+		}
+		mdao.WriteGeneralParametersJson(directory, configuration)
+		fmt.Println("parameter \"" + name + "\" saved")
+	default:
+		commandFailed(errors.New("unknown subcommand \"config " + args[0] + "\""))
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"marcellozaniboni.net/httpiccolo/bruteforce"
+	"marcellozaniboni.net/httpiccolo/mdao"
+	"marcellozaniboni.net/httpiccolo/mutils"
+)
+
+// These tests serve parallel requests through the same handler used by
+// the server; run them with "go test -race" to detect data races.
+
+// testPasswords are the passwords of the users of the test
+// configuration; their hashes are legacy sha256, so that the first
+// login also upgrades them while other requests read the state.
+var testPasswords = map[string]string{"admin": "adminpass", "bob": "bobpass"}
+
+// csrfTokenPattern extracts the CSRF token from a page
+var csrfTokenPattern = regexp.MustCompile(`name="csrf_token" type="hidden" value="([0-9a-f]+)"`)
+
+func TestMain(m *testing.M) {
+	// the handlers log every request
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestState creates a configuration directory and a root directory
+// with a public and a private directory ("/priv", readable by bob), and
+// publishes the initial state.
+func newTestState(t *testing.T) {
+	t.Helper()
+	configpath = t.TempDir()
+	root := t.TempDir()
+	for _, directory := range []string{"/pub", "/priv"} {
+		if err := os.Mkdir(root+directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(root+directory+"/file.txt", []byte("content of "+directory), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configuration := map[string]string{
+		"root_directory": root,
+		"http_port":      "8080",
+		"admin_path":     "admin",
+		"admin_users":    "admin",
+	}
+	users := map[string]string{}
+	for username, password := range testPasswords {
+		sum := sha256.Sum256([]byte(password))
+		users[username] = hex.EncodeToString(sum[:])
+	}
+	permissions := map[string]string{"/priv": "bob"}
+	writePermissions := map[string]string{}
+	tokens := map[string]mdao.JsonToken{}
+	mdao.WriteGeneralParametersJson(configpath, configuration)
+	mdao.WriteUsersJson(configpath, users)
+	mdao.WritePermissionsJson(configpath, permissions, writePermissions)
+	mdao.WriteTokensJson(configpath, tokens)
+	setState(&appState{
+		configuration:    configuration,
+		users:            users,
+		permissions:      permissions,
+		writePermissions: writePermissions,
+		tokens:           tokens,
+	})
+}
+
+// serve sends a request to the handler of the main server and returns
+// the response; ip is the address of the client.
+func serve(method string, target string, form url.Values, ip string, cookies []*http.Cookie) *http.Response {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	r := httptest.NewRequest(method, target, body)
+	r.RemoteAddr = ip + ":40000"
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, r)
+	return w.Result()
+}
+
+// login logs a user in through the login form and returns the cookies
+// of the session.
+func login(t *testing.T, username string, password string, ip string) []*http.Cookie {
+	form := url.Values{"username": {username}, "password": {password}, "redirect_url": {"/"}}
+	response := serve(http.MethodPost, "/login_action", form, ip, nil)
+	return response.Cookies()
+}
+
+// responseBody reads the body of a response.
+func responseBody(response *http.Response) string {
+	content, _ := io.ReadAll(response.Body)
+	return string(content)
+}
+
+func TestUpdateStateConcurrentWriters(t *testing.T) {
+	newTestState(t)
+	const writers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			updateState(func(s *appState) {
+				s.permissions["/dir"+strconv.Itoa(i)] = "bob"
+			})
+		}(i)
+		go func() {
+			defer wg.Done()
+			// a snapshot is never modified after being published
+			st := state()
+			for directory, users := range st.permissions {
+				if directory == "" || users == "" {
+					t.Errorf("invalid permission %q: %q", directory, users)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// the writers are serialized: no update is lost
+	if n := len(state().permissions); n != writers+1 {
+		t.Errorf("%d permissions, expected %d", n, writers+1)
+	}
+}
+
+func TestParallelBrowsing(t *testing.T) {
+	newTestState(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := "192.0.2." + strconv.Itoa(i+1)
+			for _, target := range []string{"/", "/pub", "/pub/file.txt"} {
+				if response := serve(http.MethodGet, target, nil, ip, nil); response.StatusCode != http.StatusOK {
+					t.Errorf("GET %s: status %d", target, response.StatusCode)
+				}
+			}
+			// scripts get 401 for private files
+			if response := serve(http.MethodGet, "/priv/file.txt", nil, ip, nil); response.StatusCode != http.StatusUnauthorized {
+				t.Errorf("GET /priv/file.txt: status %d, expected %d", response.StatusCode, http.StatusUnauthorized)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestRequestPathsOutsideRoot(t *testing.T) {
+	newTestState(t)
+	for _, target := range []string{"/pub/../priv/file.txt", "/../../etc/hostname"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.URL.Path = target
+		w := httptest.NewRecorder()
+		newServeMux().ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("GET %s: status %d, expected a redirect to the cleaned path", target, w.Code)
+		}
+		// without the ServeMux the handler refuses the path
+		w = httptest.NewRecorder()
+		httpGenaralHandler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, expected %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestParallelLogins(t *testing.T) {
+	newTestState(t)
+	var wg sync.WaitGroup
+	// the same user logs in from several clients: the legacy hash is
+	// upgraded once, while the other logins are verified
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := "198.51.100." + strconv.Itoa(i+1)
+			cookies := login(t, "bob", testPasswords["bob"], ip)
+			response := serve(http.MethodGet, "/priv/file.txt", nil, ip, cookies)
+			if body := responseBody(response); response.StatusCode != http.StatusOK || body != "content of /priv" {
+				t.Errorf("GET /priv/file.txt after login: status %d, body %q", response.StatusCode, body)
+			}
+		}(i)
+	}
+	// failed logins from the same address get it banned
+	const attackerIp = "203.0.113.1"
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cookies := login(t, "bob", "wrong", attackerIp)
+			response := serve(http.MethodGet, "/priv/file.txt", nil, attackerIp, cookies)
+			if response.StatusCode == http.StatusOK {
+				t.Error("GET /priv/file.txt allowed after a failed login")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !bruteforce.Banned(attackerIp) {
+		t.Error("the address of the failed logins is not banned")
+	}
+	if scheme := mutils.PasswordScheme(state().users["bob"]); scheme != mutils.PasswordSchemeArgon2id {
+		t.Errorf("password hash scheme %q after login, expected %q", scheme, mutils.PasswordSchemeArgon2id)
+	}
+	if ok, _ := mutils.VerifyPassword(testPasswords["bob"], mdao.ReadUsers(configpath)["bob"]); !ok {
+		t.Error("the upgraded password hash saved in users.json is not valid")
+	}
+}
+
+func TestAdminEditsWhileBrowsing(t *testing.T) {
+	newTestState(t)
+	const adminIp = "192.0.2.200"
+	cookies := login(t, "admin", testPasswords["admin"], adminIp)
+	console := serve(http.MethodGet, "/admin", nil, adminIp, cookies)
+	match := csrfTokenPattern.FindStringSubmatch(responseBody(console))
+	if match == nil {
+		t.Fatal("no CSRF token in the admin console")
+	}
+	csrf := match[1]
+	cookies = append(cookies, console.Cookies()...)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	// anonymous users browse while the permissions change
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := "192.0.2." + strconv.Itoa(i+1)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				response := serve(http.MethodGet, "/pub/file.txt", nil, ip, nil)
+				if status := response.StatusCode; status != http.StatusOK && status != http.StatusUnauthorized {
+					t.Errorf("GET /pub/file.txt: status %d", status)
+				}
+				serve(http.MethodGet, "/pub", nil, ip, nil)
+			}
+		}(i)
+	}
+	// the administrator makes /pub private and public again
+	for i := 0; i < 20; i++ {
+		actions := []struct {
+			target string
+			form   url.Values
+		}{
+			{"/admin/new_perm", url.Values{"new_perm_path": {"/pub"}, "new_perm_userlist": {"bob"}}},
+			{"/admin/change_perm", url.Values{"change_perm_path": {"/pub"}, "change_perm_userlist": {"bob,admin"}}},
+			{"/admin/delete_perm", url.Values{"delete_perm_path": {"/pub"}}},
+		}
+		for _, action := range actions {
+			action.form.Set(csrfTokenField, csrf)
+			if response := serve(http.MethodPost, action.target, action.form, adminIp, cookies); response.StatusCode != http.StatusOK {
+				t.Fatalf("POST %s: status %d", action.target, response.StatusCode)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	permissions, _ := mdao.ReadPermissions(configpath)
+	if _, found := permissions["/pub"]; found || permissions["/priv"] != "bob" {
+		t.Errorf("permissions saved after the edits: %v", permissions)
+	}
+	if response := serve(http.MethodGet, "/pub/file.txt", nil, "192.0.2.1", nil); response.StatusCode != http.StatusOK {
+		t.Errorf("GET /pub/file.txt after the edits: status %d", response.StatusCode)
+	}
+}
@@ -41,13 +41,14 @@ func configWizard(directory string) {
 	fmt.Println("")
 	fmt.Println("\thttpiccolo -h")
 	fmt.Println("")
-	fmt.Println("Please answer just four questions to configure httpiccolo.")
+	fmt.Println("Please answer just four questions (and an optional fifth one)")
+	fmt.Println("to configure httpiccolo.")
 
 	// admin username
 	fmt.Print("\nAdministrator username (e.g. many people use \"admin\")? ")
 	adminUsername := mutils.ReadStdinLine()
-	if adminUsername == "" {
-		mutils.FatalMessage("Error: the username cannot be empty.")
+	if err := checkAdminUsername(adminUsername); err != nil {
+		mutils.FatalMessage("Error: " + err.Error() + ".")
 	}
 
 	// admin password
@@ -58,19 +59,15 @@ func configWizard(directory string) {
 	}
 	adminPassword := string(bytepassword)
 	fmt.Println()
-	if len(adminPassword) < 5 {
-		mutils.FatalMessage("Error: the password must be at least 5 characters long.")
+	if err := checkAdminPassword(adminPassword); err != nil {
+		mutils.FatalMessage("Error: " + err.Error() + ".")
 	}
 
 	// server port
 	fmt.Print("HTTP port number (e.g. many people use 8080 or 80)? ")
-	stringport := mutils.ReadStdinLine()
-	port, err := strconv.Atoi(stringport)
+	port, err := mdao.ParsePort(mutils.ReadStdinLine())
 	if err != nil {
-		mutils.FatalMessage("Error: insert a number.")
-	}
-	if port < 20 || port > 65535 {
-		mutils.FatalMessage("Error: insert a number between 20 and 65535.")
+		mutils.FatalMessage("Error: " + err.Error() + ".")
 	}
 
 	// root directory
@@ -79,24 +76,28 @@ func configWizard(directory string) {
 	fmt.Println("Example for absolute an path on Windows:\n\tC:/webtools/httpiccolo/webcontent\n\t(yes, please use forward slashes)")
 	fmt.Println("Example for absolute an path on Linux/Unix:\n\t/home/yourusername/public")
 	fmt.Print("Root directory? ")
-	rootDirectory := mutils.ReadStdinLine()
-	rootDirectory = mutils.BackToForwardSlashes(rootDirectory)
-	for strings.HasSuffix(rootDirectory, "/") {
-		// trimming the ending slashes from path
-		rootDirectory = rootDirectory[0:(len(rootDirectory) - 1)]
+	rootDirectory, err := checkRootDirectory(mutils.ReadStdinLine())
+	if err != nil {
+		mutils.FatalMessage("Error: " + err.Error() + ".")
 	}
 
-	finfo, err := os.Stat(rootDirectory)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			mutils.FatalMessage("Error: directory " + rootDirectory + " does not exist.")
-		} else {
-			mutils.FatalError("error while checking root directory \""+rootDirectory+"\"", err)
+	// optional self-signed certificate for HTTPS
+	fmt.Println("\nOptionally, httpiccolo can generate a self-signed certificate and")
+	fmt.Println("serve HTTPS from the first run, so that passwords never travel in")
+	fmt.Println("clear text. Browsers will warn about the certificate the first time.")
+	fmt.Print("Generate a self-signed certificate for HTTPS [y/n]? ")
+	generateCertificate := mutils.ReadStdinLine()
+	useTLS := strings.EqualFold(generateCertificate, "y") || strings.EqualFold(generateCertificate, "yes")
+	var certificateHosts []string
+	if useTLS {
+		fmt.Println("Enter the host names and IP addresses used to reach this server,")
+		fmt.Println("separated by commas. Example:\n\tlocalhost,127.0.0.1,myserver.lan,192.168.1.10")
+		fmt.Print("Host names and IP addresses? ")
+		certificateHosts, err = parseCertificateHosts(mutils.ReadStdinLine())
+		if err != nil {
+			mutils.FatalMessage("Error: " + err.Error() + ".")
 		}
 	}
-	if !finfo.IsDir() {
-		mutils.FatalMessage("Error: " + rootDirectory + " is not a directory.")
-	}
 
 	// final check
 	fmt.Println()
@@ -112,6 +113,11 @@ func configWizard(directory string) {
 	}
 	fmt.Println()
 	fmt.Println(" - HTTP port: \"" + strconv.Itoa(port) + "\"")
+	if useTLS {
+		fmt.Println(" - HTTPS with a self-signed certificate for: \"" + strings.Join(certificateHosts, ",") + "\"")
+	} else {
+		fmt.Println(" - HTTPS: disabled")
+	}
 	fmt.Println()
 	if !userDefinedConfigDir {
 		fmt.Println("IMPORTANT NOTICE")
@@ -137,17 +143,10 @@ func configWizard(directory string) {
 		if os.IsExist(err) {
 			mutils.FatalMessage("Error: the directory \"" + directory + "\" exists,\nif you want to reset the configuration, delete it.")
 		}
-		users = make(map[string]string, 10)
-		configuration = make(map[string]string, 10)
-		permissions = make(map[string]string, 10)
-		users[adminUsername] = mutils.HashPassword(adminPassword)
-		configuration["admin_path"] = "admin"
-		configuration["admin_users"] = adminUsername
-		configuration["root_directory"] = rootDirectory
-		configuration["http_port"] = strconv.Itoa(port)
-		mdao.WriteUsersJson(directory, users)
-		mdao.WritePermissionsJson(directory, permissions)
-		mdao.WriteGeneralParametersJson(directory, configuration)
+		err = saveNewConfiguration(directory, adminUsername, adminPassword, port, rootDirectory, certificateHosts)
+		if err != nil {
+			mutils.FatalError("error while saving the configuration:", err)
+		}
 		fmt.Println("Configuration saved!\nPlease restart...")
 		time.Sleep(6 * time.Second)
 		os.Exit(0)
@@ -156,3 +155,85 @@ func configWizard(directory string) {
 		os.Exit(0)
 	}
 }
+
+// checkAdminUsername validates the username of the first administrator.
+func checkAdminUsername(username string) error {
+	if username == "" {
+		return errors.New("the username cannot be empty")
+	}
+	return nil
+}
+
+// checkAdminPassword validates the password of the first administrator.
+func checkAdminPassword(password string) error {
+	if len(password) < 5 {
+		return errors.New("the password must be at least 5 characters long")
+	}
+	return nil
+}
+
+// checkRootDirectory normalizes the root directory of a new
+// configuration and checks that it exists.
+func checkRootDirectory(rootDirectory string) (string, error) {
+	rootDirectory = mutils.BackToForwardSlashes(rootDirectory)
+	for strings.HasSuffix(rootDirectory, "/") {
+		// trimming the ending slashes from path
+		rootDirectory = rootDirectory[0:(len(rootDirectory) - 1)]
+	}
+	finfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", errors.New("directory " + rootDirectory + " does not exist")
+		}
+		return "", fmt.Errorf("error while checking root directory \"%s\": %w", rootDirectory, err)
+	}
+	if !finfo.IsDir() {
+		return "", errors.New(rootDirectory + " is not a directory")
+	}
+	return rootDirectory, nil
+}
+
+// parseCertificateHosts splits a comma separated list of host names and
+// IP addresses for the self-signed certificate.
+func parseCertificateHosts(list string) ([]string, error) {
+	var hosts []string
+	for _, h := range strings.Split(list, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("insert at least one host name or IP address")
+	}
+	return hosts, nil
+}
+
+// saveNewConfiguration writes the three json files of a new
+// configuration into an existing directory; when certificateHosts is
+// not empty, a self-signed certificate is generated and HTTPS enabled.
+func saveNewConfiguration(directory string, adminUsername string, adminPassword string, port int, rootDirectory string, certificateHosts []string) error {
+	users := make(map[string]string, 10)
+	configuration := make(map[string]string, 10)
+	permissions := make(map[string]string, 10)
+	writePermissions := make(map[string]string, 10)
+	users[adminUsername] = mutils.HashPassword(adminPassword)
+	configuration["admin_path"] = "admin"
+	configuration["admin_users"] = adminUsername
+	configuration["root_directory"] = rootDirectory
+	configuration["http_port"] = strconv.Itoa(port)
+	if len(certificateHosts) > 0 {
+		certFile := directory + "/cert.pem"
+		keyFile := directory + "/key.pem"
+		err := mutils.GenerateSelfSignedCertificate(certFile, keyFile, certificateHosts)
+		if err != nil {
+			return fmt.Errorf("error while generating the self-signed certificate: %w", err)
+		}
+		configuration["tls_cert_file"] = certFile
+		configuration["tls_key_file"] = keyFile
+	}
+	mdao.WriteUsersJson(directory, users)
+	mdao.WritePermissionsJson(directory, permissions, writePermissions)
+	mdao.WriteGeneralParametersJson(directory, configuration)
+	return nil
+}
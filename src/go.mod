@@ -2,6 +2,9 @@ module marcellozaniboni.net/httpiccolo
 
 go 1.19
 
-require golang.org/x/term v0.0.0-20220722155259-a9ba230a4035
+require (
+	golang.org/x/crypto v0.14.0
+	golang.org/x/term v0.13.0
+)
 
-require golang.org/x/sys v0.0.0-20220829200755-d48e67d00261 // indirect
+require golang.org/x/sys v0.13.0 // indirect
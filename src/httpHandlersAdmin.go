@@ -20,8 +20,11 @@ package main
 // 675 Mass Ave, Cambridge, MA 02139, USA.
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"html"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -40,12 +43,21 @@ import (
 // Being read from the session, username can be "".
 func verifyLoggedUser(w http.ResponseWriter, r *http.Request) (string, bool) {
 	accessGranted := false // by default nobody can
-	// read logged username
-	session := msession.GetSession(w, r)
-	username := session.Get("username")
-	session.Save()
+	var username string
+	if token, found := bearerToken(r); found {
+		// scripts and API clients: no session and no cookies
+		username = tokenUser(r, token)
+	} else if user, pass, found := r.BasicAuth(); found {
+		// wget, curl, download managers: no session and no cookies
+		username = basicAuthUser(r, user, pass)
+	} else {
+		// read logged username
+		session := msession.GetSession(w, r)
+		username = session.Get("username")
+		session.Save()
+	}
 	// verify if it's an administrator
-	administrators := strings.Split(configuration["admin_users"], ",")
+	administrators := strings.Split(state().configuration["admin_users"], ",")
 	for _, administrator := range administrators {
 		if administrator == username {
 			accessGranted = true
@@ -55,6 +67,59 @@ func verifyLoggedUser(w http.ResponseWriter, r *http.Request) (string, bool) {
 	return username, accessGranted
 }
 
+// csrfTokenField is the name of the form field containing the CSRF token
+const csrfTokenField string = "csrf_token"
+
+// csrfToken returns the CSRF token of the current session, creating it
+// if needed; the token must be embedded in every form of the admin and
+// write actions. Warning: this function uses session and cookies, so
+// call it before writing the response body.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	session := msession.GetSession(w, r)
+	token := session.Get(csrfTokenField)
+	if token == "" {
+		token = mutils.RandomToken(32)
+		session.Set(csrfTokenField, token)
+	}
+	session.Save()
+	return token
+}
+
+// verifyAdminPost checks that an admin action is a POST request
+// containing the CSRF token of the session. If the check fails, the
+// request is logged and answered with an error, and false is returned.
+// Requests authenticated with an API token do not need the CSRF token,
+// because browsers never send it automatically.
+func verifyAdminPost(w http.ResponseWriter, r *http.Request, action string) bool {
+	if r.Method != http.MethodPost {
+		log.Println(action + " action: method " + r.Method + " refused")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "method not allowed")
+		return false
+	}
+	if _, found := bearerToken(r); found {
+		return true
+	}
+	r.ParseForm()
+	return verifyCsrfToken(w, r, action, r.PostForm.Get(csrfTokenField))
+}
+
+// verifyCsrfToken checks that sent is the CSRF token of the session. If
+// the check fails, the request is logged and answered with an error,
+// and false is returned.
+func verifyCsrfToken(w http.ResponseWriter, r *http.Request, action string, sent string) bool {
+	session := msession.GetSession(w, r)
+	expected := session.Get(csrfTokenField)
+	if expected == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) != 1 {
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		log.Println(action + " action: invalid CSRF token, request refused (IP \"" + ip + "\")")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "invalid or expired form, reload the page and try again")
+		return false
+	}
+	return true
+}
+
 func websaveconfigurationaction(w http.ResponseWriter, r *http.Request) {
 	username, isAdmin := verifyLoggedUser(w, r)
 	if !isAdmin {
@@ -62,15 +127,59 @@ func websaveconfigurationaction(w http.ResponseWriter, r *http.Request) {
 		log.Println("save configuration action, access denied for user \"" + username + "\"")
 		fmt.Fprintln(w, "access denied for user \""+username+"\"")
 	} else {
+		if !verifyAdminPost(w, r, "save configuration") {
+			return
+		}
 		r.ParseForm()
-		log.Println("admin page - save configuration, ", r.Form)
-		for k, v := range r.Form {
-			configuration[k] = v[0]
-		}
-		mdao.WriteGeneralParametersJson(configpath, configuration)
-		restartneeded = true
-		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - saving configuration", false, restartneeded, false))
-		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+configuration["admin_path"]))
+		// only the known parameters are accepted; the form also contains
+		// the CSRF token, which must not be logged
+		received := map[string]string{}
+		for _, name := range mdao.GeneralParameterNames {
+			if v, found := r.PostForm[name]; found {
+				received[name] = v[0]
+			}
+		}
+		log.Println("admin page - save configuration, ", received)
+		// the new configuration is validated and applied before saving
+		// it: if something goes wrong, the current one stays in use
+		var err error
+		var restart, portChanged bool
+		updateState(func(s *appState) {
+			next := cloneStringMap(s.configuration)
+			for k, v := range received {
+				next[k] = v
+			}
+			if err = mdao.ValidateGeneralParameters(next); err != nil {
+				return
+			}
+			if restart, err = applyConfiguration(next); err != nil {
+				return
+			}
+			portChanged = next["http_port"] != s.configuration["http_port"]
+			s.configuration = next
+			mdao.WriteGeneralParametersJson(configpath, s.configuration)
+		})
+		if err != nil {
+			log.Println("admin page - save configuration - error:", err)
+			fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - saving configuration", false, restartneeded.Load(), false))
+			fmt.Fprintln(w, "<p>The configuration has not been saved: "+html.EscapeString(err.Error())+"</p>")
+			fmt.Fprintln(w, "<br/>&nbsp;<br/><a href=\"/"+state().configuration["admin_path"]+"?nonache="+mutils.RandomId(noCacheIdLength)+"\">Go back to the settings</a>")
+			fmt.Fprintln(w, mstatic.HtmlFooter)
+			return
+		}
+		// the banner disappears if the settings needing a restart
+		// are set back to the values in use
+		if restart {
+			log.Println("admin page - save configuration - some settings need a restart")
+		}
+		restartneeded.Store(restart)
+		redirectpath := "/" + state().configuration["admin_path"]
+		if portChanged {
+			// this listener is closing: continue on the new port
+			redirectpath = serverUrl(r) + redirectpath
+		}
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - saving configuration", false, restartneeded.Load(), false))
+		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction(redirectpath))
 		fmt.Fprintln(w, mstatic.HtmlFooter)
 	}
 }
@@ -82,6 +191,9 @@ func webchangepasswordaction(w http.ResponseWriter, r *http.Request) {
 		log.Println("change password action, access denied for user \"" + username + "\"")
 		fmt.Fprintln(w, "access denied for user \""+username+"\"")
 	} else {
+		if !verifyAdminPost(w, r, "change password") {
+			return
+		}
 		r.ParseForm()
 		form := r.Form
 		log.Println("admin page - change password, ", form)
@@ -95,11 +207,14 @@ func webchangepasswordaction(w http.ResponseWriter, r *http.Request) {
 		}
 		if u != "" && p != "" {
 			// save only valid users
-			users[u] = mutils.HashPassword(p)
-			mdao.WriteUsersJson(configpath, users)
+			hash := mutils.HashPassword(p)
+			updateState(func(s *appState) {
+				s.users[u] = hash
+				mdao.WriteUsersJson(configpath, s.users)
+			})
 		}
-		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - changing password", false, restartneeded, false))
-		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+configuration["admin_path"]))
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - changing password", false, restartneeded.Load(), false))
+		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+state().configuration["admin_path"]))
 		fmt.Fprintln(w, mstatic.HtmlFooter)
 	}
 }
@@ -111,6 +226,9 @@ func webdeleteuseraction(w http.ResponseWriter, r *http.Request) {
 		log.Println("delete user action, access denied for user \"" + username + "\"")
 		fmt.Fprintln(w, "access denied for user \""+username+"\"")
 	} else {
+		if !verifyAdminPost(w, r, "delete user") {
+			return
+		}
 		r.ParseForm()
 		form := r.Form
 		log.Println("admin page - delete user, ", form)
@@ -122,11 +240,40 @@ func webdeleteuseraction(w http.ResponseWriter, r *http.Request) {
 		}
 		if u != "" {
 			// delete user
-			delete(users, u)
-			mdao.WriteUsersJson(configpath, users)
+			updateState(func(s *appState) {
+				delete(s.users, u)
+				mdao.WriteUsersJson(configpath, s.users)
+				// revoke the API tokens of the user
+				if revokeUserTokens(s, u) > 0 {
+					mdao.WriteTokensJson(configpath, s.tokens)
+				}
+			})
+			// and terminate the sessions of the user
+			msession.DeleteSessions("username", u)
+		}
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - deleting user", false, restartneeded.Load(), false))
+		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+state().configuration["admin_path"]))
+		fmt.Fprintln(w, mstatic.HtmlFooter)
+	}
+}
+
+func weblogoutuseraction(w http.ResponseWriter, r *http.Request) {
+	username, isAdmin := verifyLoggedUser(w, r)
+	if !isAdmin {
+		// login needed
+		log.Println("logout user action, access denied for user \"" + username + "\"")
+		fmt.Fprintln(w, "access denied for user \""+username+"\"")
+	} else {
+		if !verifyAdminPost(w, r, "logout user") {
+			return
+		}
+		r.ParseForm()
+		u := r.Form.Get("logout_user_usr")
+		if u != "" {
+			log.Println("admin page - logout user \""+u+"\", terminated sessions:", msession.DeleteSessions("username", u))
 		}
-		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - deleting user", false, restartneeded, false))
-		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+configuration["admin_path"]))
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - logging out user", false, restartneeded.Load(), false))
+		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+state().configuration["admin_path"]))
 		fmt.Fprintln(w, mstatic.HtmlFooter)
 	}
 }
@@ -138,9 +285,11 @@ func webnewuseraction(w http.ResponseWriter, r *http.Request) {
 		log.Println("admin page - new user action, access denied for user \"" + username + "\"")
 		fmt.Fprintln(w, "access denied for user \""+username+"\"")
 	} else {
+		if !verifyAdminPost(w, r, "new user") {
+			return
+		}
 		r.ParseForm()
 		form := r.Form
-		log.Println("admin page - new user action, ", form)
 		var u, p string
 		for k, v := range form {
 			if k == "new_user_usr" {
@@ -149,16 +298,29 @@ func webnewuseraction(w http.ResponseWriter, r *http.Request) {
 				p = v[0]
 			}
 		}
+		log.Println("admin page - new user action, user \"" + u + "\"")
 		if u != "" && p != "" {
+			// the same validation of the "user add" command
+			if err := checkUsername(u); err != nil {
+				log.Println("admin page - new user action - error:", err)
+				fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new user", false, restartneeded.Load(), false))
+				fmt.Fprintln(w, "<p>The user has not been saved: "+html.EscapeString(err.Error())+"</p>")
+				fmt.Fprintln(w, "<br/>&nbsp;<br/><a href=\"/"+state().configuration["admin_path"]+"?nonache="+mutils.RandomId(noCacheIdLength)+"\">Go back to the settings</a>")
+				fmt.Fprintln(w, mstatic.HtmlFooter)
+				return
+			}
 			// save only valid users
 			// note that if the username already exists, the existing item is overwritten
-			users[u] = mutils.HashPassword(p)
-			mdao.WriteUsersJson(configpath, users)
+			hash := mutils.HashPassword(p)
+			updateState(func(s *appState) {
+				s.users[u] = hash
+				mdao.WriteUsersJson(configpath, s.users)
+			})
 		} else {
 			log.Println("admin page - new user action - error: user or password are empty; nothing to save")
 		}
-		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new user", false, restartneeded, false))
-		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+configuration["admin_path"]))
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new user", false, restartneeded.Load(), false))
+		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+state().configuration["admin_path"]))
 		fmt.Fprintln(w, mstatic.HtmlFooter)
 	}
 }
@@ -170,25 +332,32 @@ func webnewpermaction(w http.ResponseWriter, r *http.Request) {
 		log.Println("new permission action, access denied for user \"" + username + "\"")
 		fmt.Fprintln(w, "access denied for user \""+username+"\"")
 	} else {
+		if !verifyAdminPost(w, r, "new permission") {
+			return
+		}
 		r.ParseForm()
 		form := r.Form
 		log.Println("admin page - new perm, ", form)
-		var path, ulist string
+		var path, ulist, wlist string
 		for k, v := range form {
 			if k == "new_perm_path" {
 				path = v[0]
 			} else if k == "new_perm_userlist" {
 				ulist = v[0]
+			} else if k == "new_perm_writelist" {
+				wlist = v[0]
 			}
 		}
 		// save only valid permissions
-		if path != "" && ulist != "" {
-			// note: if the path already exist, the user list will be overwritten
-			permissions[path] = ulist
-			mdao.WritePermissionsJson(configpath, permissions)
+		if path != "" && (ulist != "" || wlist != "") {
+			// note: if the path already exist, the user lists will be overwritten
+			updateState(func(s *appState) {
+				setPermission(s, path, ulist, wlist)
+				mdao.WritePermissionsJson(configpath, s.permissions, s.writePermissions)
+			})
 		}
-		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new permission", false, restartneeded, false))
-		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+configuration["admin_path"]))
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new permission", false, restartneeded.Load(), false))
+		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+state().configuration["admin_path"]))
 		fmt.Fprintln(w, mstatic.HtmlFooter)
 	}
 }
@@ -200,24 +369,31 @@ func webchangepermaction(w http.ResponseWriter, r *http.Request) {
 		log.Println("change permission action, access denied for user \"" + username + "\"")
 		fmt.Fprintln(w, "access denied for user \""+username+"\"")
 	} else {
+		if !verifyAdminPost(w, r, "change permission") {
+			return
+		}
 		r.ParseForm()
 		form := r.Form
 		log.Println("admin page - change perm, ", form)
-		var path, ulist string
+		var path, ulist, wlist string
 		for k, v := range form {
 			if k == "change_perm_path" {
 				path = v[0]
 			} else if k == "change_perm_userlist" {
 				ulist = v[0]
+			} else if k == "change_perm_writelist" {
+				wlist = v[0]
 			}
 		}
-		if path != "" && ulist != "" {
+		if path != "" && (ulist != "" || wlist != "") {
 			// save only valid users
-			permissions[path] = ulist
-			mdao.WritePermissionsJson(configpath, permissions)
+			updateState(func(s *appState) {
+				setPermission(s, path, ulist, wlist)
+				mdao.WritePermissionsJson(configpath, s.permissions, s.writePermissions)
+			})
 		}
-		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - change permission", false, restartneeded, false))
-		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+configuration["admin_path"]))
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - change permission", false, restartneeded.Load(), false))
+		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+state().configuration["admin_path"]))
 		fmt.Fprintln(w, mstatic.HtmlFooter)
 	}
 }
@@ -229,6 +405,9 @@ func webdeleteperm(w http.ResponseWriter, r *http.Request) {
 		log.Println("delete permission action, access denied for user \"" + username + "\"")
 		fmt.Fprintln(w, "access denied for user \""+username+"\"")
 	} else {
+		if !verifyAdminPost(w, r, "delete permission") {
+			return
+		}
 		r.ParseForm()
 		form := r.Form
 		log.Println("admin page - delete perm, ", form)
@@ -239,12 +418,15 @@ func webdeleteperm(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if path != "" {
-			// delete user
-			delete(permissions, path)
-			mdao.WritePermissionsJson(configpath, permissions)
+			// delete both read and write grants
+			updateState(func(s *appState) {
+				delete(s.permissions, path)
+				delete(s.writePermissions, path)
+				mdao.WritePermissionsJson(configpath, s.permissions, s.writePermissions)
+			})
 		}
-		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - deleting permission", false, restartneeded, false))
-		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+configuration["admin_path"]))
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - deleting permission", false, restartneeded.Load(), false))
+		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+state().configuration["admin_path"]))
 		fmt.Fprintln(w, mstatic.HtmlFooter)
 	}
 }
@@ -257,23 +439,49 @@ func webadminconsole(w http.ResponseWriter, r *http.Request) {
 		webloginform(w, r, username)
 	} else {
 		log.Println("admin page, user \"" + username + "\"")
-		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings", false, restartneeded, false))
-		html := strings.Replace(mstatic.HtmlAdminBody, "[root_directory]", configuration["root_directory"], 1)
-		html = strings.Replace(html, "[http_port]", configuration["http_port"], 1)
-		html = strings.Replace(html, "[admin_path]", configuration["admin_path"], 1)
-		html = strings.Replace(html, "[admin_users]", configuration["admin_users"], 1)
+		csrf := csrfToken(w, r)
+		st := state()
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings", false, restartneeded.Load(), false))
+		html := strings.Replace(mstatic.HtmlAdminBody, "[root_directory]", st.configuration["root_directory"], 1)
+		html = strings.Replace(html, "[http_port]", st.configuration["http_port"], 1)
+		html = strings.Replace(html, "[admin_path]", st.configuration["admin_path"], 1)
+		html = strings.Replace(html, "[admin_users]", st.configuration["admin_users"], 1)
+		html = strings.Replace(html, "[tls_cert_file]", st.configuration["tls_cert_file"], 1)
+		html = strings.Replace(html, "[tls_key_file]", st.configuration["tls_key_file"], 1)
+		html = strings.Replace(html, "[http_redirect_port]", st.configuration["http_redirect_port"], 1)
+		html = strings.Replace(html, "[max_upload_mb]", st.configuration["max_upload_mb"], 1)
+		html = strings.Replace(html, "[session_store]", st.configuration["session_store"], 1)
+		html = strings.Replace(html, "[session_idle_minutes]", st.configuration["session_idle_minutes"], 1)
+		html = strings.Replace(html, "[cookie_samesite]", st.configuration["cookie_samesite"], 1)
+		html = strings.Replace(html, "[archive_max_mb]", st.configuration["archive_max_mb"], 1)
+		html = strings.Replace(html, "[archive_max_files]", st.configuration["archive_max_files"], 1)
+		html = strings.Replace(html, "[inline_extensions]", st.configuration["inline_extensions"], 1)
+		html = strings.Replace(html, "[default_inline_extensions]", defaultInlineExtensions, 1)
+		html = strings.Replace(html, "[download_extensions]", st.configuration["download_extensions"], 1)
+		html = strings.Replace(html, "[show_readme]", st.configuration["show_readme"], 1)
+		html = strings.Replace(html, "[thumbnail_directory]", st.configuration["thumbnail_directory"], 1)
+		html = strings.Replace(html, "[config_watch_seconds]", st.configuration["config_watch_seconds"], 1)
+		html = strings.Replace(html, "[read_timeout_seconds]", st.configuration["read_timeout_seconds"], 1)
+		html = strings.Replace(html, "[write_timeout_seconds]", st.configuration["write_timeout_seconds"], 1)
+		html = strings.Replace(html, "[idle_timeout_seconds]", st.configuration["idle_timeout_seconds"], 1)
+		html = strings.Replace(html, "[shutdown_timeout_seconds]", st.configuration["shutdown_timeout_seconds"], 1)
 		html = strings.Replace(html, "[valign]", "style='vertical-align: middle'", -1)
-		html = strings.Replace(html, "[userlist]", mstatic.GetHtmlUserTable(users), 1)
-		html = strings.Replace(html, "[permissionlist]", mstatic.GetHtmlPermissionTable(permissions), 1)
-		html = strings.Replace(html, "[save_config_action]", "/"+configuration["admin_path"]+"/save_config", 1)
+		html = strings.Replace(html, "[userlist]", mstatic.GetHtmlUserTable(st.users), 1)
+		html = strings.Replace(html, "[permissionlist]", mstatic.GetHtmlPermissionTable(st.permissions, st.writePermissions), 1)
+		html = strings.Replace(html, "[tokenlist]", mstatic.GetHtmlTokenTable(st.tokens, st.users), 1)
+		html = strings.Replace(html, "[new_token_action]", "/"+st.configuration["admin_path"]+"/new_token", 1)
+		html = strings.Replace(html, "[save_config_action]", "/"+st.configuration["admin_path"]+"/save_config", 1)
 		html += mstatic.HtmlAdminJavascriptAndHiddenForms
-		html = strings.Replace(html, "[change_password_action]", "/"+configuration["admin_path"]+"/change_password", 1)
-		html = strings.Replace(html, "[new_user_action]", "/"+configuration["admin_path"]+"/new_user", 1)
-		html = strings.Replace(html, "[delete_user_action]", "/"+configuration["admin_path"]+"/delete_user", 1)
-		html = strings.Replace(html, "[new_perm_form_url]", "/"+configuration["admin_path"]+"/new_perm_form"+"?nonache="+mutils.RandomId(noCacheIdLength), 1)
-		html = strings.Replace(html, "[new_user_form_url]", "/"+configuration["admin_path"]+"/new_user_form"+"?nonache="+mutils.RandomId(noCacheIdLength), 1)
-		html = strings.Replace(html, "[change_permusers_action]", "/"+configuration["admin_path"]+"/change_perm", 1)
-		html = strings.Replace(html, "[delete_perm_action]", "/"+configuration["admin_path"]+"/delete_perm", 1)
+		html = strings.Replace(html, "[change_password_action]", "/"+st.configuration["admin_path"]+"/change_password", 1)
+		html = strings.Replace(html, "[new_user_action]", "/"+st.configuration["admin_path"]+"/new_user", 1)
+		html = strings.Replace(html, "[delete_user_action]", "/"+st.configuration["admin_path"]+"/delete_user", 1)
+		html = strings.Replace(html, "[logout_user_action]", "/"+st.configuration["admin_path"]+"/logout_user", 1)
+		html = strings.Replace(html, "[new_perm_form_url]", "/"+st.configuration["admin_path"]+"/new_perm_form"+"?nonache="+mutils.RandomId(noCacheIdLength), 1)
+		html = strings.Replace(html, "[new_user_form_url]", "/"+st.configuration["admin_path"]+"/new_user_form"+"?nonache="+mutils.RandomId(noCacheIdLength), 1)
+		html = strings.Replace(html, "[change_permusers_action]", "/"+st.configuration["admin_path"]+"/change_perm", 1)
+		html = strings.Replace(html, "[delete_perm_action]", "/"+st.configuration["admin_path"]+"/delete_perm", 1)
+		html = strings.Replace(html, "[csrf_token]", csrf, -1)
+		html = strings.Replace(html, "[revoke_token_action]", "/"+st.configuration["admin_path"]+"/revoke_token", 1)
 		fmt.Fprintln(w, html)
 		fmt.Fprintln(w, "<!-- httpiccolo version "+httpiccoloVersion+" -->")
 		fmt.Fprintln(w, mstatic.HtmlFooter)
@@ -289,8 +497,10 @@ func webnewpermform(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("new permission form, user \"" + username + "\"")
-	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new private directory", false, restartneeded, false))
-	var rootpath string = configuration["root_directory"]
+	csrf := csrfToken(w, r)
+	users := state().users
+	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new private directory", false, restartneeded.Load(), false))
+	var rootpath string = state().configuration["root_directory"]
 	for strings.HasSuffix(rootpath, "/") || strings.HasSuffix(rootpath, "\\") {
 		// trimming the ending slashes from path
 		rootpath = rootpath[0:(len(rootpath) - 1)]
@@ -307,15 +517,18 @@ func webnewpermform(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "ERROR: one or more directories under the root directory are not readable.")
 		fmt.Fprintln(w, "Reconfigure root directory and try again.<br/>")
 		fmt.Fprintln(w, err)
-		fmt.Fprintln(w, "<br/>&nbsp;<br/><a href=\"/"+configuration["admin_path"]+"?nonache="+mutils.RandomId(noCacheIdLength)+"\">Go back to the settings</a>")
+		fmt.Fprintln(w, "<br/>&nbsp;<br/><a href=\"/"+state().configuration["admin_path"]+"?nonache="+mutils.RandomId(noCacheIdLength)+"\">Go back to the settings</a>")
 	} else {
-		fmt.Fprintln(w, "<p>Select the users that will access the private directory:</p>")
+		fmt.Fprintln(w, "<p>Select the users that will access the private directory and the users that will be able")
+		fmt.Fprintln(w, "to write into it (upload files and so on). If only write users are selected, the directory")
+		fmt.Fprintln(w, "stays public for reading.</p>")
 		fmt.Fprintln(w, "<table class=\"w3-table-all\">")
-		fmt.Fprintln(w, "<tr><th>configured user</th></tr>")
+		fmt.Fprintln(w, "<tr><th>configured user</th><th>read</th><th>write</th></tr>")
 		var id int = 0
 		for u := range users {
-			fmt.Fprintln(w, "<tr><td><input type=\"checkbox\" id=\"usr_"+strconv.Itoa(id)+"\" name=\"usr_"+strconv.Itoa(id)+"\" value=\""+u+"\"/>")
-			fmt.Fprintln(w, "<label for=\"usr_"+strconv.Itoa(id)+"\">"+u+"</label></td></tr>")
+			fmt.Fprintln(w, "<tr><td>"+u+"</td>")
+			fmt.Fprintln(w, "<td><input type=\"checkbox\" id=\"usr_"+strconv.Itoa(id)+"\" name=\"usr_"+strconv.Itoa(id)+"\" value=\""+u+"\"/></td>")
+			fmt.Fprintln(w, "<td><input type=\"checkbox\" id=\"wusr_"+strconv.Itoa(id)+"\" name=\"wusr_"+strconv.Itoa(id)+"\" value=\""+u+"\"/></td></tr>")
 			id++
 		}
 		fmt.Fprintln(w, "</table>")
@@ -330,6 +543,9 @@ func webnewpermform(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "<tr><th>available directories</th></tr>")
 		id = 0
 		for _, d := range directories {
+			// the names of the directories are created by the users with
+			// a write grant too
+			d = html.EscapeString(d)
 			pathLength := strings.LastIndex(d, "/")
 			fmt.Fprintln(w, "<tr>")
 			fmt.Fprintln(w, "<td><input type=\"radio\" id=\"dir_"+strconv.Itoa(id)+"\" name=\"directory\" value=\"/"+d+"\"/>")
@@ -345,20 +561,27 @@ func webnewpermform(w http.ResponseWriter, r *http.Request) {
 		}
 		fmt.Fprintln(w, "</table>")
 	}
-	fmt.Fprintln(w, "<div style=\"margin-top: 16px; margin-bottom: 6px\" align=\"center\"><a href=\"../"+configuration["admin_path"]+"?nonache="+mutils.RandomId(noCacheIdLength)+"\">Cancel (bo back)</a>")
+	fmt.Fprintln(w, "<div style=\"margin-top: 16px; margin-bottom: 6px\" align=\"center\"><a href=\"../"+state().configuration["admin_path"]+"?nonache="+mutils.RandomId(noCacheIdLength)+"\">Cancel (bo back)</a>")
 	fmt.Fprintln(w, "&nbsp;&nbsp;&nbsp;<a href=\"#\" onclick=\"createPermission()\">Save</a></div>")
 	fmt.Fprintln(w, `
-	<form id="new_perm_form" name="new_perm_form" action="/`+configuration["admin_path"]+`/new_perm" method="post">
+	<form id="new_perm_form" name="new_perm_form" action="/`+state().configuration["admin_path"]+`/new_perm" method="post">
+	<input name="csrf_token" type="hidden" value="`+csrf+`"/>
 	<input id="new_perm_path" name="new_perm_path" type="hidden" value=""/>
-	<input id="new_perm_userlist" name="new_perm_userlist" type="hidden" value=""/></form>
+	<input id="new_perm_userlist" name="new_perm_userlist" type="hidden" value=""/>
+	<input id="new_perm_writelist" name="new_perm_writelist" type="hidden" value=""/></form>
 	<script type="text/javascript" charset="utf-8">
 	function createPermission() {
 		var userlist = "";
+		var writelist = "";
 		for (var i = 0; i < `+strconv.Itoa(len(users))+`; i++) {
 			if (document.getElementById("usr_" + i).checked) {
 				if (userlist != "") userlist += ",";
 				userlist += document.getElementById("usr_" + i).value;
 			}
+			if (document.getElementById("wusr_" + i).checked) {
+				if (writelist != "") writelist += ",";
+				writelist += document.getElementById("wusr_" + i).value;
+			}
 		}
 		var path = "";
 		for (var i=0; i < `+strconv.Itoa(directoryCount)+`; i++) {
@@ -367,7 +590,7 @@ func webnewpermform(w http.ResponseWriter, r *http.Request) {
 				break;
 			}
 		}
-		if (userlist == "") {
+		if (userlist == "" && writelist == "") {
 			alert("Select one or more users.");
 			return;
 		}
@@ -377,6 +600,7 @@ func webnewpermform(w http.ResponseWriter, r *http.Request) {
 		}
 		document.getElementById("new_perm_path").value = path;
 		document.getElementById("new_perm_userlist").value = userlist;
+		document.getElementById("new_perm_writelist").value = writelist;
 		document.getElementById("new_perm_form").submit();
 	}
 	</script>`)
@@ -394,7 +618,8 @@ func webnewuserform(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("new user form, user \"" + username + "\"")
-	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new user", false, restartneeded, false))
+	csrf := csrfToken(w, r)
+	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new user", false, restartneeded.Load(), false))
 
 	fmt.Fprintln(w, "<table class='w3-bordered w3-hoverable'>")
 	fmt.Fprintln(w, "<tr>")
@@ -412,11 +637,12 @@ func webnewuserform(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "</table>")
 
 	fmt.Fprintln(w, "<!-- httpiccolo version "+httpiccoloVersion+" -->")
-	fmt.Fprintln(w, "<div style=\"margin-top: 16px; margin-bottom: 6px\"><a href=\"../"+configuration["admin_path"]+"?nonache="+mutils.RandomId(noCacheIdLength)+"\">Cancel (bo back)</a>")
+	fmt.Fprintln(w, "<div style=\"margin-top: 16px; margin-bottom: 6px\"><a href=\"../"+state().configuration["admin_path"]+"?nonache="+mutils.RandomId(noCacheIdLength)+"\">Cancel (bo back)</a>")
 	fmt.Fprintln(w, "&nbsp;&nbsp;&nbsp;<a href=\"#\" onclick=\"createUser()\">Save</a></div>")
 
 	fmt.Fprintln(w, `
-	<form id="new_user_form" name="new_user_form" action="/`+configuration["admin_path"]+`/new_user" method="post">
+	<form id="new_user_form" name="new_user_form" action="/`+state().configuration["admin_path"]+`/new_user" method="post">
+	<input name="csrf_token" type="hidden" value="`+csrf+`"/>
 	<input id="new_user_usr" name="new_user_usr" type="hidden" value=""/>
 	<input id="new_user_pwd" name="new_user_pwd" type="hidden" value=""/>
 	<script type="text/javascript" charset="utf-8">
@@ -438,3 +664,18 @@ func webnewuserform(w http.ResponseWriter, r *http.Request) {
 	</script>`)
 	fmt.Fprintln(w, mstatic.HtmlFooter)
 }
+
+// setPermission stores the read and the write user lists of a directory
+// into the state s; an empty list removes the corresponding grant.
+func setPermission(s *appState, path string, ulist string, wlist string) {
+	if ulist != "" {
+		s.permissions[path] = ulist
+	} else {
+		delete(s.permissions, path)
+	}
+	if wlist != "" {
+		s.writePermissions[path] = wlist
+	} else {
+		delete(s.writePermissions, path)
+	}
+}
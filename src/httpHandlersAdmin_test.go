@@ -0,0 +1,74 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// adminSession logs the administrator in and returns the cookies of the
+// session and the CSRF token of the administration page.
+func adminSession(t *testing.T) ([]*http.Cookie, string) {
+	t.Helper()
+	cookies := login(t, "admin", testPasswords["admin"], "10.0.0.1")
+	m := csrfTokenPattern.FindStringSubmatch(responseBody(serve(http.MethodGet, "/admin", nil, "10.0.0.1", cookies)))
+	if m == nil {
+		t.Fatal("no CSRF token in the administration page")
+	}
+	return cookies, m[1]
+}
+
+func TestNewUserValidation(t *testing.T) {
+	newTestState(t)
+	cookies, csrf := adminSession(t)
+	for username, valid := range map[string]bool{"carol": true, "eve,bob": false, "eve bob": false} {
+		form := url.Values{"csrf_token": {csrf}, "new_user_usr": {username}, "new_user_pwd": {"password"}}
+		serve(http.MethodPost, "/admin/new_user", form, "10.0.0.1", cookies)
+		if _, found := state().users[username]; found != valid {
+			t.Errorf("user %q saved: %v", username, found)
+		}
+	}
+}
+
+func TestSaveConfigurationLog(t *testing.T) {
+	newTestState(t)
+	cookies, csrf := adminSession(t)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(io.Discard)
+	// the invalid port stops the action before the listeners change
+	form := url.Values{"csrf_token": {csrf}, "http_port": {"none"}, "unknown_parameter": {"value"}}
+	serve(http.MethodPost, "/admin/save_config", form, "10.0.0.1", cookies)
+	if strings.Contains(logged.String(), csrf) {
+		t.Error("the CSRF token was logged")
+	}
+	if strings.Contains(logged.String(), "unknown_parameter") {
+		t.Error("the unknown parameter was accepted")
+	}
+	if !strings.Contains(logged.String(), "http_port:none") {
+		t.Errorf("the parameters were not logged: %s", logged.String())
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"marcellozaniboni.net/httpiccolo/mstatic"
+	"marcellozaniboni.net/httpiccolo/mutils"
+)
+
+// defaultArchiveMaxMiB and defaultArchiveMaxFiles are used when
+// archive_max_mb and archive_max_files are not configured
+const defaultArchiveMaxMiB int64 = 4096
+const defaultArchiveMaxFiles int = 10000
+
+// archiveEntry is a file or a directory that will be written into
+// an archive.
+type archiveEntry struct {
+	name         string // name inside the archive
+	resourcepath string // physical filesystem path
+	info         fs.FileInfo
+}
+
+// errArchiveTooLarge is returned when the archive exceeds the limits
+var errArchiveTooLarge = errors.New("archive too large")
+
+// archiveLimits returns the maximum total size in bytes of the files
+// contained in an archive, and the maximum number of files.
+func archiveLimits() (int64, int) {
+	maxSize, err := strconv.ParseInt(state().configuration["archive_max_mb"], 10, 64)
+	if err != nil || maxSize < 1 {
+		maxSize = defaultArchiveMaxMiB
+	}
+	maxFiles, err := strconv.Atoi(state().configuration["archive_max_files"])
+	if err != nil || maxFiles < 1 {
+		maxFiles = defaultArchiveMaxFiles
+	}
+	return maxSize * 1024 * 1024, maxFiles
+}
+
+// webarchivedownload streams a zip or tar.gz archive containing the
+// requested files and directories (the "path" query parameters). The
+// archive is built on the fly, subdirectories the user is not allowed
+// to read are skipped.
+func webarchivedownload(w http.ResponseWriter, r *http.Request) {
+	username, _ := verifyLoggedUser(w, r)
+	r.ParseForm()
+	format := r.Form.Get("format")
+	if format != "zip" && format != "targz" {
+		log.Println("archive download: unknown format \"" + format + "\"")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "unknown archive format")
+		return
+	}
+
+	var httppaths []string
+	for _, requested := range r.Form["path"] {
+		httppath, _, ok := resolveWebPath(requested)
+		if !ok {
+			log.Println("archive download: invalid path \"" + requested + "\" from user \"" + username + "\"")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, mstatic.ErrNoContent)
+			return
+		}
+		isPrivate, readAllowed := readGrant(username, httppath)
+		if isPrivate && !readAllowed {
+			log.Println("archive download: access denied for user \"" + username + "\" to \"" + httppath + "\"")
+			denyAccess(w, r, username)
+			return
+		}
+		httppaths = append(httppaths, httppath)
+	}
+	if len(httppaths) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "nothing selected")
+		return
+	}
+
+	entries, err := collectArchiveEntries(username, httppaths)
+	if err != nil {
+		log.Println("archive download: user \""+username+"\", paths", httppaths, "-", err)
+		maxSize, maxFiles := archiveLimits()
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - archive download", false, restartneeded.Load(), false))
+		if errors.Is(err, errArchiveTooLarge) {
+			fmt.Fprintln(w, "<p>Sorry, the archive would be too large: the limits are "+mutils.FormatFileSize(maxSize)+
+				" and "+strconv.Itoa(maxFiles)+" files.</p>")
+		} else {
+			fmt.Fprintln(w, "<p>"+mstatic.ErrNoContent+"</p>")
+		}
+		fmt.Fprintln(w, mstatic.HtmlFooter)
+		return
+	}
+
+	// the archive is named after the only selected item, or after
+	// the directory containing the selected items
+	archiveName := path.Base(httppaths[0])
+	if len(httppaths) > 1 {
+		archiveName = path.Base(parentWebPath(httppaths[0]))
+	}
+	if archiveName == "/" || archiveName == "." || archiveName == "" {
+		archiveName = "httpiccolo"
+	}
+	log.Println("archive download: user \""+username+"\", format "+format+",", len(entries), "entries from", httppaths)
+	if format == "zip" {
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(archiveName+".zip"))
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeZipArchive(w, entries)
+	} else {
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(archiveName+".tar.gz"))
+		w.Header().Set("Content-Type", "application/gzip")
+		err = writeTarGzArchive(w, entries)
+	}
+	if err != nil {
+		// the response has already started: the client gets a truncated archive
+		log.Println("archive download: error while streaming the archive:", err)
+	}
+}
+
+// collectArchiveEntries walks the requested paths and returns the list
+// of entries of the archive, checking the configured limits before
+// anything is written to the client.
+func collectArchiveEntries(username string, httppaths []string) ([]archiveEntry, error) {
+	maxSize, maxFiles := archiveLimits()
+	var totalSize int64
+	var fileCount int
+	var entries []archiveEntry
+	for _, httppath := range httppaths {
+		baseResourcepath := rootDirectory() + httppath
+		parentResourcepath := rootDirectory() + parentWebPath(httppath)
+		err := filepath.WalkDir(baseResourcepath, func(resourcepath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relative := mutils.BackToForwardSlashes(resourcepath[len(parentResourcepath):])
+			if d.IsDir() {
+				// private subdirectories are skipped for users without a grant
+				isPrivate, readAllowed := readGrant(username, parentWebPath(httppath)+relative)
+				if isPrivate && !readAllowed {
+					return filepath.SkipDir
+				}
+			} else if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), uploadTempPrefix) {
+				// symbolic links, devices and incomplete uploads are skipped
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				fileCount++
+				totalSize += info.Size()
+				if fileCount > maxFiles || totalSize > maxSize {
+					return errArchiveTooLarge
+				}
+			}
+			name := strings.TrimPrefix(relative, "/")
+			if name == "" {
+				// the root directory itself
+				return nil
+			}
+			entries = append(entries, archiveEntry{name: name, resourcepath: resourcepath, info: info})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// writeZipArchive writes the entries into a zip stream.
+func writeZipArchive(w io.Writer, entries []archiveEntry) error {
+	archive := zip.NewWriter(w)
+	for _, entry := range entries {
+		header, err := zip.FileInfoHeader(entry.info)
+		if err != nil {
+			return err
+		}
+		header.Name = entry.name
+		if entry.info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		writer, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if !entry.info.IsDir() {
+			if err := copyFileInto(writer, entry.resourcepath); err != nil {
+				return err
+			}
+		}
+	}
+	return archive.Close()
+}
+
+// writeTarGzArchive writes the entries into a gzip compressed tar stream.
+func writeTarGzArchive(w io.Writer, entries []archiveEntry) error {
+	compressor := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressor)
+	for _, entry := range entries {
+		header, err := tar.FileInfoHeader(entry.info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = entry.name
+		if entry.info.IsDir() {
+			header.Name += "/"
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if !entry.info.IsDir() {
+			if err := copyFileInto(archive, entry.resourcepath); err != nil {
+				return err
+			}
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// copyFileInto copies the content of a file into a writer.
+func copyFileInto(w io.Writer, resourcepath string) error {
+	file, err := os.Open(resourcepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
@@ -21,15 +21,18 @@ package main
 
 import (
 	"fmt"
-	"io"
+	"html"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"strconv"
+	"path"
 	"strings"
 	"time"
 
 	"marcellozaniboni.net/httpiccolo/mstatic"
+	"marcellozaniboni.net/httpiccolo/msyntax"
 	"marcellozaniboni.net/httpiccolo/mutils"
 )
 
@@ -52,7 +55,7 @@ func webgenericbrowsing(w http.ResponseWriter, r *http.Request) {
 	// httppath is the logical web path
 	var httppath string = r.URL.Path
 	// rootpath on the filesystem for published contents
-	var rootpath string = configuration["root_directory"]
+	var rootpath string = state().configuration["root_directory"]
 	for strings.HasSuffix(httppath, "/") || strings.HasSuffix(httppath, "\\") {
 		// trimming the ending slashes from path
 		httppath = httppath[0:(len(httppath) - 1)]
@@ -71,7 +74,11 @@ func webgenericbrowsing(w http.ResponseWriter, r *http.Request) {
 	info, err := os.Stat(resourcepath)
 	if err != nil {
 		time.Sleep(4 * time.Second) // penalty time
-		fmt.Fprintln(w, mstatic.ErrNoContent)
+		if wantsJson(r) {
+			writeJsonError(w, http.StatusNotFound, mstatic.ErrNoContent)
+		} else {
+			fmt.Fprintln(w, mstatic.ErrNoContent)
+		}
 		log.Print("nothing found for \"" + httppath + "\"")
 		return
 	}
@@ -79,24 +86,17 @@ func webgenericbrowsing(w http.ResponseWriter, r *http.Request) {
 	// check if the requested resource is private and in this case check if
 	// the logged user is permitted to get it and if not, redirect to the
 	// login form, setting the requested resource as the redirect URL
-	isPrivate := false
-	noGrantFound := true
-	for privateDirectory, allowedUsers := range permissions {
-		if strings.HasPrefix(httppath, privateDirectory) {
-			isPrivate = true
-			allowedUserSlice := strings.Split(allowedUsers, ",")
-			for _, u := range allowedUserSlice {
-				if username == u {
-					noGrantFound = false
-					break
-				}
-			}
-		}
-	}
-	if isPrivate && noGrantFound {
+	isPrivate, readAllowed := readGrant(username, httppath)
+	if isPrivate && !readAllowed {
 		// the directory is private and the user is not allowed >>> login form
 		log.Println("access denied for user " + username + " to " + httppath)
-		webloginform(w, r, username)
+		denyAccess(w, r, username)
+		return
+	}
+
+	// directory listing for scripts
+	if info.IsDir() && wantsJson(r) {
+		webjsonlisting(w, username, httppath, resourcepath)
 		return
 	}
 
@@ -114,22 +114,38 @@ func webgenericbrowsing(w http.ResponseWriter, r *http.Request) {
 		if httppath == "" {
 			title += "/"
 		} else {
-			title += httppath
+			title += html.EscapeString(httppath)
 		}
-		htmlHeader := mstatic.GetHtmlHeader(title, true, restartneeded, true)
-		if username == "" {
-			htmlHeader = strings.ReplaceAll(htmlHeader, "[logged_username]", "<span class=\"w3-text-dark-grey\"><i>anonymous</i></span>")
-		} else {
-			if isAdmin {
-				htmlHeader = strings.ReplaceAll(htmlHeader, "[logged_username]", "<span class=\"w3-text-red\">"+username+"</span>")
-			} else {
-				htmlHeader = strings.ReplaceAll(htmlHeader, "[logged_username]", username)
+		if r.Form.Get("view") == "gallery" {
+			webgallery(w, r, username, isAdmin, title, httppath, infos)
+			return
+		}
+		// users with a write grant can also modify the contents; the
+		// CSRF token of their forms must be created before writing
+		canWrite := writeGrant(username, httppath)
+		csrf := ""
+		if canWrite {
+			csrf = csrfToken(w, r)
+		}
+		fmt.Fprintln(w, browsingHeader(w, r, title, username, isAdmin))
+		for _, f := range infos {
+			if !f.IsDir() && galleryImage(f.Name()) {
+				directoryurl := (&url.URL{Path: httppath}).EscapedPath()
+				if httppath == "" {
+					directoryurl = "/"
+				}
+				fmt.Fprintln(w, mstatic.GetHtmlViewSwitch(directoryurl, false))
+				break
 			}
 		}
-		fmt.Fprintln(w, htmlHeader)
 
 		// table containing the fines inside the directory
-		fmt.Fprintln(w, "<table class='w3-table-all'>\n<tr><th>name</th><th>size</th><th>time</th></tr>")
+		fmt.Fprintln(w, mstatic.HtmlSelectionFormBegin)
+		fmt.Fprint(w, "<table class='w3-table-all'>\n<tr><th>name</th><th>size</th><th>time</th>")
+		if canWrite {
+			fmt.Fprint(w, "<th>actions</th>")
+		}
+		fmt.Fprintln(w, "</tr>")
 		if httppath != "" { // link to the partent directory ".."
 			var parentDirectoryHttpPath string
 			i := strings.LastIndex(httppath, "/")
@@ -140,9 +156,13 @@ func webgenericbrowsing(w http.ResponseWriter, r *http.Request) {
 			}
 			fmt.Fprintln(w, "<tr class='w3-hover-text-brown'>")
 			fmt.Fprint(w, "<td title='open parent directory'><font color='#666666'>&uuarr;</font>")
-			fmt.Fprint(w, "<a href='"+parentDirectoryHttpPath+"?nonache="+mutils.RandomId(noCacheIdLength)+"'><b>&nbsp;..&nbsp;</b></a>")
+			fmt.Fprint(w, "<a href='"+html.EscapeString((&url.URL{Path: parentDirectoryHttpPath}).EscapedPath())+"?nonache="+mutils.RandomId(noCacheIdLength)+"'><b>&nbsp;..&nbsp;</b></a>")
 			fmt.Fprint(w, "<font color='#666666'>&uuarr;</font></a></td>")
-			fmt.Fprintln(w, "<td>-</td><td>-</td></tr>")
+			fmt.Fprint(w, "<td>-</td><td>-</td>")
+			if canWrite {
+				fmt.Fprint(w, "<td>-</td>")
+			}
+			fmt.Fprintln(w, "</tr>")
 		}
 
 		// stat counters will be printed under the table
@@ -158,14 +178,15 @@ func webgenericbrowsing(w http.ResponseWriter, r *http.Request) {
 				} else {
 					checkKey = httppath + "/" + f.Name()
 				}
-				_, lockedDir := permissions[checkKey]
+				_, lockedDir := state().permissions[checkKey]
 
-				if lockedDir && username == "" {
+				if entryHidden(username, checkKey, f) {
 					// lot logged users cannot see private directory names
 					log.Println("private directory name " + f.Name() + " hidden for anonymous users")
 				} else {
 					fmt.Fprintln(w, "<tr class='w3-hover-text-brown'>")
-					fmt.Fprintln(w, "<td>[<a href='"+httppath+"/"+f.Name()+"?nonache="+mutils.RandomId(noCacheIdLength)+"'>"+f.Name()+"]</a></td>")
+					dirurl := (&url.URL{Path: checkKey}).EscapedPath()
+					fmt.Fprintln(w, "<td>"+mstatic.GetHtmlSelectionCheckbox(checkKey)+"[<a href='"+html.EscapeString(dirurl)+"?nonache="+mutils.RandomId(noCacheIdLength)+"'>"+html.EscapeString(f.Name())+"]</a></td>")
 					fmt.Fprint(w, "<td><small><i>directory")
 					if lockedDir {
 						fmt.Fprint(w, " [PRIVATE]")
@@ -180,12 +201,15 @@ func webgenericbrowsing(w http.ResponseWriter, r *http.Request) {
 						modificationTime = fileinfo.ModTime().Format("2006-01-02 15:04:05")
 					}
 					fmt.Fprintln(w, "<td>"+modificationTime+"</td>")
+					if canWrite {
+						fmt.Fprintln(w, "<td>"+mstatic.GetHtmlWriteActions(checkKey, f.Name())+"</td>")
+					}
 					fmt.Fprintln(w, "</tr>")
 				}
 			}
 		}
 		for _, f := range infos { // main loop files
-			if !f.IsDir() {
+			if !f.IsDir() && !entryHidden(username, httppath+"/"+f.Name(), f) {
 				var fileSize int64 = 0
 				modificationTime := "???"
 				fileinfo, err := f.Info()
@@ -196,15 +220,28 @@ func webgenericbrowsing(w http.ResponseWriter, r *http.Request) {
 					fileSize = fileinfo.Size()
 				}
 				fmt.Fprintln(w, "<tr class='w3-hover-text-indigo'>")
-				fmt.Fprintln(w, "<td><a href='"+httppath+"/"+f.Name()+"?nocache="+mutils.RandomId(noCacheIdLength)+"'>"+f.Name()+"</a></td>")
+				// the name link shows or downloads the file as configured, the
+				// small link next to it gives the other choice
+				var alternativeLink string
+				fileurl := (&url.URL{Path: httppath + "/" + f.Name()}).EscapedPath()
+				if inlineByDefault(f.Name()) || hasView(f.Name()) {
+					alternativeLink = mstatic.GetHtmlAlternativeFileLink(fileurl, true)
+				} else if canOpen(f.Name()) {
+					alternativeLink = mstatic.GetHtmlAlternativeFileLink(fileurl, false)
+				}
+				fmt.Fprintln(w, "<td>"+mstatic.GetHtmlSelectionCheckbox(httppath+"/"+f.Name())+"<a href='"+html.EscapeString(fileurl)+"?nocache="+mutils.RandomId(noCacheIdLength)+"'>"+html.EscapeString(f.Name())+"</a>"+alternativeLink+"</td>")
 				fmt.Fprintln(w, "<td>"+mutils.FormatFileSize(fileSize)+"</td>")
 				fileCounter++
 				fileSizeSum += fileSize
 				fmt.Fprintln(w, "<td>"+modificationTime+"</td>")
+				if canWrite {
+					fmt.Fprintln(w, "<td>"+mstatic.GetHtmlWriteActions(httppath+"/"+f.Name(), f.Name())+"</td>")
+				}
 				fmt.Fprintln(w, "</tr>")
 			}
 		}
 		fmt.Fprintln(w, "</table>")
+		fmt.Fprintln(w, mstatic.HtmlSelectionFormEnd)
 
 		// stats section
 		fmt.Fprint(w, "<p>")
@@ -221,44 +258,159 @@ func webgenericbrowsing(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprint(w, " files, total size: ")
 		}
 		fmt.Fprintln(w, mutils.FormatFileSize(fileSizeSum)+"</p>")
+
+		// links for downloading the whole directory
+		archivePath := url.QueryEscape(httppath)
+		if httppath == "" {
+			archivePath = "%2F"
+		}
+		htmlLinks := strings.Replace(mstatic.HtmlArchiveLinks, "[zip_url]", "/download_archive?format=zip&amp;path="+archivePath, 1)
+		htmlLinks = strings.Replace(htmlLinks, "[targz_url]", "/download_archive?format=targz&amp;path="+archivePath, 1)
+		fmt.Fprintln(w, htmlLinks)
+
+		// README.md rendered under the listing, if enabled
+		if state().configuration["show_readme"] == "yes" {
+			for _, f := range infos {
+				if !f.IsDir() && strings.EqualFold(f.Name(), "README.md") {
+					writeReadme(w, username, httppath, resourcepath+"/"+f.Name())
+					break
+				}
+			}
+		}
+
+		// upload form and write actions for users allowed to write
+		if canWrite {
+			uploadDirectory := httppath
+			if uploadDirectory == "" {
+				uploadDirectory = "/"
+			}
+			htmlForm := strings.Replace(mstatic.HtmlUploadForm, "[upload_action]", "/upload_action?directory="+url.QueryEscape(uploadDirectory), 1)
+			htmlForm = strings.Replace(htmlForm, "[max_upload_size]", mutils.FormatFileSize(maxUploadSize()), 1)
+			htmlForm += mstatic.HtmlWriteActionsJavascriptAndHiddenForms
+			htmlForm = strings.Replace(htmlForm, "[current_directory]", html.EscapeString(uploadDirectory), -1)
+			htmlForm = strings.Replace(htmlForm, "[csrf_token]", csrf, -1)
+			fmt.Fprintln(w, htmlForm)
+		}
 		fmt.Fprintln(w, mstatic.HtmlFooter)
+	} else if markdownRendered(r, info) {
+		webmarkdown(w, r, username, isAdmin, httppath, resourcepath)
+	} else if sourceViewed(r, info) {
+		websource(w, r, username, isAdmin, httppath, resourcepath, info)
 	} else { // file links are served directly
-		s := strings.Split(httppath, "/")
-		if len(s) > 0 {
-			downloadFileName := s[len(s)-1] // this eliminate file path
-			log.Print("downloading: \"" + downloadFileName + "\"")
-			// files with text extension are written in the response, other files are downloaded
-			if strings.HasSuffix(strings.ToLower(downloadFileName), ".html") || strings.HasSuffix(strings.ToLower(downloadFileName), ".htm") || strings.HasSuffix(strings.ToLower(downloadFileName), ".txt") || strings.HasSuffix(strings.ToLower(downloadFileName), ".md") || strings.HasSuffix(strings.ToLower(downloadFileName), ".log") {
-				file, err := os.Open(resourcepath)
-				if err != nil {
-					fmt.Fprintln(w, "error while opening file, please report to the administrator")
-					log.Print("error while opening file "+resourcepath, err)
-					return
+		log.Print("downloading: \"" + info.Name() + "\"")
+		serveFile(w, r, resourcepath, info)
+	}
+}
+
+// browsingHeader returns the page header of directories and rendered
+// files, with the logged user and the login and logout links.
+func browsingHeader(w http.ResponseWriter, r *http.Request, title string, username string, isAdmin bool) string {
+	htmlHeader := mstatic.GetHtmlHeader(title, true, restartneeded.Load(), true)
+	if username == "" {
+		htmlHeader = strings.ReplaceAll(htmlHeader, "[logged_username]", "<span class=\"w3-text-dark-grey\"><i>anonymous</i></span>")
+		htmlHeader = strings.Replace(htmlHeader, "[logout_link]", "", 1)
+	} else {
+		// logging out is a form, protected by the CSRF token
+		logoutLink := strings.Replace(mstatic.HtmlLogoutLink, "[csrf_token]", csrfToken(w, r), 1)
+		htmlHeader = strings.Replace(htmlHeader, "[logout_link]", logoutLink, 1)
+		if isAdmin {
+			htmlHeader = strings.ReplaceAll(htmlHeader, "[logged_username]", "<span class=\"w3-text-red\">"+username+"</span>")
+		} else {
+			htmlHeader = strings.ReplaceAll(htmlHeader, "[logged_username]", username)
+		}
+	}
+	return htmlHeader
+}
+
+// hasView returns true when the files with the extension of filename
+// are shown in a page, rendered (Markdown) or highlighted (source code).
+func hasView(filename string) bool {
+	ext := mutils.FileExtension(filename)
+	if ext != "md" && ext != "markdown" && msyntax.LanguageOf(ext) == nil {
+		return false
+	}
+	return !extensionListed(filename, state().configuration["download_extensions"])
+}
+
+// entryHidden returns true when a directory entry must not be shown to
+// the user: anonymous users cannot see private directory names, and
+// nobody can see incomplete uploads.
+func entryHidden(username string, itempath string, entry fs.DirEntry) bool {
+	if entry.IsDir() {
+		_, lockedDir := state().permissions[itempath]
+		return lockedDir && username == ""
+	}
+	return strings.HasPrefix(entry.Name(), uploadTempPrefix)
+}
+
+// rootDirectory returns the configured root directory without the
+// ending slashes.
+func rootDirectory() string {
+	var rootpath string = state().configuration["root_directory"]
+	for strings.HasSuffix(rootpath, "/") || strings.HasSuffix(rootpath, "\\") {
+		// trimming the ending slashes from path
+		rootpath = rootpath[0:(len(rootpath) - 1)]
+	}
+	return rootpath
+}
+
+// resolveWebPath cleans a web path received from the client (e.g. in
+// a form) and returns it together with the corresponding filesystem
+// path. As in webgenericbrowsing, the root is the empty web path. The
+// last value is false when the path is not acceptable, for example
+// when it would escape the root directory.
+func resolveWebPath(webpath string) (string, string, bool) {
+	if strings.ContainsAny(webpath, "\\\x00") {
+		return "", "", false
+	}
+	for _, element := range strings.Split(webpath, "/") {
+		if element == ".." {
+			return "", "", false
+		}
+	}
+	httppath := path.Clean("/" + webpath)
+	if httppath == "/" {
+		httppath = ""
+	}
+	return httppath, rootDirectory() + httppath, true
+}
+
+// readGrant checks the read permissions for a web path. The first value
+// is true when the path is private, the second one is true when the
+// user is allowed to read it.
+func readGrant(username string, httppath string) (bool, bool) {
+	isPrivate := false
+	allowed := false
+	for privateDirectory, allowedUsers := range state().permissions {
+		if strings.HasPrefix(httppath, privateDirectory) {
+			isPrivate = true
+			allowedUserSlice := strings.Split(allowedUsers, ",")
+			for _, u := range allowedUserSlice {
+				if username == u {
+					allowed = true
+					break
 				}
-				defer file.Close()
-				buffer := make([]byte, 4096)
-				for {
-					count, err := file.Read(buffer)
-					if err != nil {
-						if err != io.EOF {
-							fmt.Fprintln(w, "error while reading file, please report to the administrator")
-							log.Print("error while reading file "+resourcepath, err)
-							return
-						}
-						break
-					}
-					if count > 0 {
-						w.Write(buffer[:count])
-					}
+			}
+		}
+	}
+	return isPrivate, allowed
+}
+
+// writeGrant returns true when the user is allowed to write into the
+// directory httppath, that is when the directory or one of its parents
+// has a write grant for the user.
+func writeGrant(username string, httppath string) bool {
+	if username == "" {
+		return false
+	}
+	for writableDirectory, allowedUsers := range state().writePermissions {
+		if httppath == writableDirectory || strings.HasPrefix(httppath, writableDirectory+"/") {
+			for _, u := range strings.Split(allowedUsers, ",") {
+				if username == u {
+					return true
 				}
-			} else { // other files must be downloaded
-				w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(downloadFileName))
-				w.Header().Set("Content-Type", "application/octet-stream")
-				http.ServeFile(w, r, resourcepath)
 			}
-		} else {
-			// this should never happen
-			log.Println("error: unable to determine file name for " + httppath)
 		}
 	}
+	return false
 }
@@ -0,0 +1,195 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"marcellozaniboni.net/httpiccolo/mutils"
+)
+
+// defaultInlineExtensions are shown in the browser when
+// inline_extensions is not configured; html is not included, because
+// the pages uploaded by the users would run on the same origin as the
+// admin console
+const defaultInlineExtensions string = "txt,md,log,pdf,png,jpg,jpeg,gif,webp,bmp,ico,mp4,webm,ogv,mp3,ogg,oga,wav,flac,m4a"
+
+// etagWeakPeriod is the time after the last modification during which
+// the ETag of a file is weak: the file can still be changing without a
+// new modification time.
+const etagWeakPeriod time.Duration = time.Second
+
+// serveFile sends a file to the browser, with the Content-Type
+// detected from the extension or from the content. The file is shown
+// in the browser or downloaded as configured (see inlineByDefault),
+// unless the link asks for the other choice: "download" forces the
+// download, "open" shows the file if its type cannot run scripts.
+func serveFile(w http.ResponseWriter, r *http.Request, resourcepath string, info fs.FileInfo) {
+	filename := info.Name()
+	file, err := os.Open(resourcepath)
+	if err != nil {
+		fmt.Fprintln(w, "error while opening file, please report to the administrator")
+		log.Print("error while opening file "+resourcepath, err)
+		return
+	}
+	defer file.Close()
+	// the file could have been replaced after the first check
+	info, err = file.Stat()
+	if err != nil {
+		fmt.Fprintln(w, "error while reading file, please report to the administrator")
+		log.Print("error while reading file "+resourcepath, err)
+		return
+	}
+
+	head := make([]byte, mutils.SniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		fmt.Fprintln(w, "error while reading file, please report to the administrator")
+		log.Print("error while reading file "+resourcepath, err)
+		return
+	}
+	contentType := mutils.ContentType(filename, head[:n])
+
+	inline := inlineByDefault(filename)
+	if r.Form.Get("download") != "" {
+		inline = false
+	} else if r.Form.Get("open") != "" && !inline {
+		mediatype, _, _ := mime.ParseMediaType(contentType)
+		inline = safeInlineType(mediatype)
+	}
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+		contentType = inlineContentType(contentType)
+		if mediatype, _, _ := mime.ParseMediaType(contentType); !safeInlineType(mediatype) {
+			// e.g. html configured in inline_extensions: the scripts
+			// run in a unique origin, without access to the site
+			w.Header().Set("Content-Security-Policy", "sandbox")
+		}
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	w.Header().Set("Content-Type", contentType)
+	// the browser must not guess another type, e.g. html in a text file
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	serveFileContent(w, r, file, info)
+}
+
+// serveFileContent is the common path for sending the content of the
+// files: it supports byte ranges (resumed downloads, tailing a log),
+// HEAD and the conditional requests (If-None-Match, If-Modified-Since,
+// If-Range and so on), based on ETag and Last-Modified. The other
+// headers, like Content-Type, must be set by the caller.
+func serveFileContent(w http.ResponseWriter, r *http.Request, file *os.File, info fs.FileInfo) {
+	w.Header().Set("ETag", fileETag(info))
+	// the browsers can keep a copy, but they must check that it is
+	// still valid; private files must not be kept by shared caches
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// fileETag returns the entity tag of a file, built from its size and
+// modification time. The tag is weak while the file could be changing
+// (see etagWeakPeriod): a weak tag can validate a cached copy, but it
+// cannot be used for resuming a download with If-Range.
+func fileETag(info fs.FileInfo) string {
+	etag := "\"" + strconv.FormatInt(info.Size(), 16) + "-" + strconv.FormatInt(info.ModTime().UnixNano(), 16) + "\""
+	if time.Since(info.ModTime()) < etagWeakPeriod {
+		etag = "W/" + etag
+	}
+	return etag
+}
+
+// inlineByDefault returns true when a file must be shown in the
+// browser rather than downloaded: the extensions in download_extensions
+// are always downloaded, those in inline_extensions are always shown,
+// the others are shown only if their type cannot run scripts.
+func inlineByDefault(filename string) bool {
+	configuration := state().configuration
+	if extensionListed(filename, configuration["download_extensions"]) {
+		return false
+	}
+	inlineExtensions := configuration["inline_extensions"]
+	if inlineExtensions == "" {
+		inlineExtensions = defaultInlineExtensions
+	}
+	if extensionListed(filename, inlineExtensions) {
+		return true
+	}
+	return safeInlineType(mutils.ExtensionContentType(filename))
+}
+
+// canOpen returns true when a file downloaded by default can be shown
+// in the browser on request; for an unknown extension the type is
+// detected from the content when the file is served.
+func canOpen(filename string) bool {
+	mediatype := mutils.ExtensionContentType(filename)
+	return mediatype == "" || safeInlineType(mediatype)
+}
+
+// safeInlineType returns true for the MIME types that browsers show
+// without running scripts.
+func safeInlineType(mediatype string) bool {
+	switch mediatype {
+	case "image/svg+xml", "text/html", "text/xml":
+		return false
+	case "application/pdf", "application/json":
+		return true
+	}
+	return strings.HasPrefix(mediatype, "text/") || strings.HasPrefix(mediatype, "image/") || strings.HasPrefix(mediatype, "audio/") || strings.HasPrefix(mediatype, "video/")
+}
+
+// inlineContentType returns the Content-Type for showing a file in the
+// browser: browsers download the text types they do not know (e.g.
+// text/markdown or text/x-log), so they are sent as plain text.
+func inlineContentType(contentType string) string {
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediatype, "text/") {
+		return contentType
+	}
+	switch mediatype {
+	case "text/html", "text/xml", "text/css", "text/plain":
+		return contentType
+	}
+	return mime.FormatMediaType("text/plain", params)
+}
+
+// extensionListed returns true when the extension of a file name is
+// in a comma separated list, e.g. "pdf,jpg,.png".
+func extensionListed(filename string, list string) bool {
+	ext := mutils.FileExtension(filename)
+	if ext == "" {
+		return false
+	}
+	for _, listed := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.ToLower(strings.TrimSpace(listed)), ".") == ext {
+			return true
+		}
+	}
+	return false
+}
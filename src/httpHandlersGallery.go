@@ -0,0 +1,231 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"image/jpeg"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"marcellozaniboni.net/httpiccolo/mstatic"
+	"marcellozaniboni.net/httpiccolo/mutils"
+)
+
+// thumbnailSize is the longest side of the thumbnails, in pixels
+const thumbnailSize int = 200
+
+// thumbnailQuality is the JPEG quality of the thumbnails
+const thumbnailQuality int = 85
+
+// thumbnailSlots limits the thumbnails created at the same time: a
+// gallery asks for many of them together, and decoding an image takes
+// a lot of memory and CPU.
+var thumbnailSlots = make(chan struct{}, runtime.NumCPU())
+
+// galleryImage returns true for the files shown as thumbnails.
+func galleryImage(filename string) bool {
+	switch mutils.FileExtension(filename) {
+	case "jpg", "jpeg", "png", "gif":
+		return true
+	}
+	return false
+}
+
+// webgallery shows a directory as a gallery: the subdirectories, the
+// thumbnails of the images, which open in a lightbox with next and
+// previous buttons, and the links to the other files.
+func webgallery(w http.ResponseWriter, r *http.Request, username string, isAdmin bool, title string, httppath string, infos []fs.DirEntry) {
+	directoryurl := (&url.URL{Path: httppath}).EscapedPath()
+	if httppath == "" {
+		directoryurl = "/"
+	}
+	fmt.Fprintln(w, browsingHeader(w, r, title, username, isAdmin))
+	fmt.Fprintln(w, mstatic.GetHtmlViewSwitch(directoryurl, true))
+
+	// subdirectories, which are shown as galleries too
+	var links []string
+	if httppath != "" {
+		parenturl := (&url.URL{Path: path.Dir(httppath)}).EscapedPath()
+		links = append(links, "<a href=\""+html.EscapeString(parenturl)+"?view=gallery\" title='open parent directory'><b>..</b></a>")
+	}
+	for _, f := range infos {
+		if f.IsDir() && !entryHidden(username, httppath+"/"+f.Name(), f) {
+			itemurl := (&url.URL{Path: httppath + "/" + f.Name()}).EscapedPath()
+			links = append(links, "[<a href=\""+html.EscapeString(itemurl)+"?view=gallery\">"+html.EscapeString(f.Name())+"</a>]")
+		}
+	}
+	if len(links) > 0 {
+		fmt.Fprintln(w, "<p>"+strings.Join(links, "&nbsp;\n")+"</p>")
+	}
+
+	// thumbnails of the images
+	var otherFiles []string
+	fmt.Fprintln(w, mstatic.HtmlGalleryBegin)
+	index := 0
+	for _, f := range infos {
+		if f.IsDir() || entryHidden(username, httppath+"/"+f.Name(), f) {
+			continue
+		}
+		itempath := httppath + "/" + f.Name()
+		itemurl := (&url.URL{Path: itempath}).EscapedPath()
+		if !galleryImage(f.Name()) {
+			otherFiles = append(otherFiles, "<li><a href=\""+html.EscapeString(itemurl)+"\">"+html.EscapeString(f.Name())+"</a></li>")
+			continue
+		}
+		fmt.Fprintln(w, mstatic.GetHtmlGalleryItem(index, itemurl, "/thumbnail?path="+url.QueryEscape(itempath), f.Name()))
+		index++
+	}
+	fmt.Fprintln(w, mstatic.HtmlGalleryEnd)
+	if index == 0 {
+		fmt.Fprintln(w, "<p><i>no images in this directory</i></p>")
+	}
+	if len(otherFiles) > 0 {
+		fmt.Fprintln(w, "<p>Other files:</p>\n<ul>\n"+strings.Join(otherFiles, "\n")+"\n</ul>")
+	}
+	fmt.Fprintln(w, mstatic.HtmlFooter)
+}
+
+// webthumbnail sends the thumbnail of the image in the "path" query
+// parameter, creating it if it is not in the cache yet. The image is
+// subject to the same permissions as the image itself.
+func webthumbnail(w http.ResponseWriter, r *http.Request) {
+	username, _ := verifyLoggedUser(w, r)
+	r.ParseForm()
+	httppath, resourcepath, ok := resolveWebPath(r.Form.Get("path"))
+	if !ok || !galleryImage(httppath) || strings.HasPrefix(path.Base(httppath), uploadTempPrefix) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, mstatic.ErrNoContent)
+		return
+	}
+	isPrivate, readAllowed := readGrant(username, httppath)
+	if isPrivate && !readAllowed {
+		log.Println("thumbnail: access denied for user \"" + username + "\" to \"" + httppath + "\"")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "access denied for user \""+username+"\"")
+		return
+	}
+	info, err := os.Stat(resourcepath)
+	if err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, mstatic.ErrNoContent)
+		return
+	}
+
+	cachepath := thumbnailPath(httppath, info)
+	if _, err := os.Stat(cachepath); err != nil {
+		if err := createThumbnail(resourcepath, cachepath); err != nil {
+			log.Println("thumbnail: cannot create the thumbnail of \""+httppath+"\":", err)
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, mstatic.ErrNoContent)
+			return
+		}
+	}
+	file, err := os.Open(cachepath)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, mstatic.ErrNoContent)
+		return
+	}
+	defer file.Close()
+	cacheinfo, err := file.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, mstatic.ErrNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	serveFileContent(w, r, file, cacheinfo)
+}
+
+// thumbnailDirectory returns the directory of the thumbnail cache.
+func thumbnailDirectory() string {
+	if directory := state().configuration["thumbnail_directory"]; directory != "" {
+		return directory
+	}
+	return configpath + "/thumbnails"
+}
+
+// thumbnailPath returns the cache file of a thumbnail. The name is made
+// of a hash of the web path, and of the modification time and the size
+// of the image: when the image changes, the name changes too.
+func thumbnailPath(httppath string, info fs.FileInfo) string {
+	hash := sha256.Sum256([]byte(httppath))
+	key := hex.EncodeToString(hash[:16])
+	return thumbnailDirectory() + "/" + key[:2] + "/" + key + "-" + strconv.FormatInt(info.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(info.Size(), 36) + ".jpg"
+}
+
+// createThumbnail creates the thumbnail of an image and saves it in
+// the cache, removing the thumbnails of the previous versions.
+func createThumbnail(resourcepath string, cachepath string) error {
+	thumbnailSlots <- struct{}{}
+	defer func() { <-thumbnailSlots }()
+	// it could have been created while waiting
+	if _, err := os.Stat(cachepath); err == nil {
+		return nil
+	}
+
+	thumbnail, err := mutils.MakeThumbnail(resourcepath, thumbnailSize)
+	if err != nil {
+		return err
+	}
+	directory := filepath.Dir(cachepath)
+	if err := os.MkdirAll(directory, 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(directory, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := jpeg.Encode(tmp, thumbnail, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), cachepath); err != nil {
+		return err
+	}
+
+	// thumbnails of the previous versions of the image
+	key := filepath.Base(cachepath)
+	key = key[:strings.IndexByte(key, '-')]
+	if previous, err := filepath.Glob(directory + "/" + key + "-*.jpg"); err == nil {
+		for _, p := range previous {
+			if filepath.Base(p) != filepath.Base(cachepath) {
+				os.Remove(p)
+			}
+		}
+	}
+	return nil
+}
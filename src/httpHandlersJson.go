@@ -0,0 +1,108 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// jsonListingEntry is an item of a directory listing in JSON format
+type jsonListingEntry struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"` // "directory" or "file"
+	Size     int64  `json:"size"` // bytes, 0 for directories
+	Modified string `json:"modified"`
+	Private  bool   `json:"private"`
+	Url      string `json:"url"`
+}
+
+// jsonListing is a directory listing in JSON format
+type jsonListing struct {
+	Path    string             `json:"path"`
+	Entries []jsonListingEntry `json:"entries"`
+}
+
+// wantsJson returns true when the client asks for JSON instead of
+// HTML, using the Accept header or the format=json query parameter.
+func wantsJson(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// webjsonlisting writes the listing of a directory in JSON format; the
+// visibility rules are the same of the HTML listing.
+func webjsonlisting(w http.ResponseWriter, username string, httppath string, resourcepath string) {
+	infos, err := os.ReadDir(resourcepath)
+	if err != nil {
+		log.Println("directory browsing error:", err)
+		writeJsonError(w, http.StatusInternalServerError, "directory browsing error, contact the system administrator")
+		return
+	}
+	listing := jsonListing{Path: httppath, Entries: []jsonListingEntry{}}
+	if listing.Path == "" {
+		listing.Path = "/"
+	}
+	for _, f := range infos {
+		itempath := httppath + "/" + f.Name()
+		if entryHidden(username, itempath, f) {
+			continue
+		}
+		fileinfo, err := f.Info()
+		if err != nil {
+			log.Println("error reading file info for " + f.Name())
+			continue
+		}
+		entry := jsonListingEntry{
+			Name:     f.Name(),
+			Type:     "file",
+			Modified: fileinfo.ModTime().Format(time.RFC3339),
+			Url:      (&url.URL{Path: itempath}).EscapedPath(),
+		}
+		if f.IsDir() {
+			entry.Type = "directory"
+		} else {
+			entry.Size = fileinfo.Size()
+		}
+		entry.Private, _ = readGrant(username, itempath)
+		listing.Entries = append(listing.Entries, entry)
+	}
+	log.Println("JSON listing of \""+listing.Path+"\" for user \""+username+"\",", len(listing.Entries), "entries")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(listing); err != nil {
+		log.Println("error while writing JSON listing:", err)
+	}
+}
+
+// writeJsonError writes an error in JSON format.
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
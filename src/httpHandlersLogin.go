@@ -25,13 +25,31 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"marcellozaniboni.net/httpiccolo/bruteforce"
+	"marcellozaniboni.net/httpiccolo/mdao"
 	"marcellozaniboni.net/httpiccolo/msession"
 	"marcellozaniboni.net/httpiccolo/mstatic"
 	"marcellozaniboni.net/httpiccolo/mutils"
 )
 
+// basicAuthCacheTime is the validity of a cached Basic authentication
+const basicAuthCacheTime time.Duration = 5 * time.Minute
+
+// basicAuthCacheSize is the maximum number of cached Basic
+// authentications
+const basicAuthCacheSize int = 1024
+
+// basicAuthCache contains the successful Basic authentications: the
+// key is a hash of the credentials, the value is the expiry time
+var basicAuthCache = map[string]time.Time{}
+
+// basicAuthCacheMutex guards basicAuthCache, since requests are
+// concurrent
+var basicAuthCacheMutex sync.Mutex
+
 // webloginform display the web page containing the login form. It is not
 // called directly by a user's action. It is called by other http handler
 // function when needed (in a sort of server-side redirection).
@@ -60,7 +78,7 @@ func webloginform(w http.ResponseWriter, r *http.Request, username string) {
 	if currentUsername == "" {
 		currentUsername = "<i>anonymous</i>"
 	}
-	fmt.Fprintln(w, mstatic.GetHtmlHeader("", true, restartneeded, false))
+	fmt.Fprintln(w, mstatic.GetHtmlHeader("", true, restartneeded.Load(), false))
 	html := strings.Replace(mstatic.HtmlLoginForm, "[current_login_username]", currentUsername, 1)
 	html = strings.Replace(html, "[redirect_url]", redirectUrl+"?nonache="+mutils.RandomId(noCacheIdLength), 1)
 	fmt.Fprintln(w, html)
@@ -97,23 +115,151 @@ func webloginaction(w http.ResponseWriter, r *http.Request) {
 			url = v[0]
 		}
 	}
-	hashedpass := mutils.HashPassword(pass)
 
 	// set the session if the login is ok
-	if users[user] == hashedpass {
+	if authenticate(ip, user, pass) {
 		s := msession.GetSession(w, r)
+		s.RenewId() // a new id prevents session fixation
 		s.Set("username", user)
 		s.Save()
-	} else {
+	}
+	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - loggin in", false, restartneeded.Load(), false))
+	fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction(url))
+	fmt.Fprintln(w, mstatic.HtmlFooter)
+
+}
+
+// weblogoutaction terminates the session of the user: the session is
+// deleted from the server and the cookie from the browser. It is a
+// POST with the CSRF token, so that other sites cannot log users out.
+func weblogoutaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		log.Println("logout action: method " + r.Method + " refused")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "method not allowed")
+		return
+	}
+	r.ParseForm()
+	if !verifyCsrfToken(w, r, "logout", r.PostForm.Get(csrfTokenField)) {
+		return
+	}
+	s := msession.GetSession(w, r)
+	log.Println("logout action, user \"" + s.Get("username") + "\"")
+	s.Destroy()
+	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - logging out", false, restartneeded.Load(), false))
+	fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"))
+	fmt.Fprintln(w, mstatic.HtmlFooter)
+}
+
+// authenticate verifies username and password. Legacy password hashes
+// are upgraded, failed attempts are recorded for brute-force control.
+func authenticate(ip string, user string, pass string) bool {
+	storedHash := state().users[user]
+	passwordOk, needsRehash := mutils.VerifyPassword(pass, storedHash)
+	if !passwordOk {
 		// record the failed attempt for brute-force control
-		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
 		if ip != "" {
 			bruteforce.RecordFailedLogin(ip)
 		}
 		log.Println("login failed for user \""+user+"\", IP \""+ip+"\", banned =", bruteforce.Banned(ip))
+		return false
 	}
-	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - loggin in", false, restartneeded, false))
-	fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction(url))
-	fmt.Fprintln(w, mstatic.HtmlFooter)
+	if needsRehash {
+		// replace the legacy (or outdated) hash now that the password is known
+		log.Println("login: upgrading the password hash of user \"" + user + "\"")
+		hash := mutils.HashPassword(pass)
+		updateState(func(s *appState) {
+			// skip it if the password was changed in the meantime
+			if s.users[user] == storedHash {
+				s.users[user] = hash
+				mdao.WriteUsersJson(configpath, s.users)
+			}
+		})
+	}
+	return true
+}
 
+// basicAuthUser returns the username sent with HTTP Basic
+// authentication, or "" if the credentials are not valid. Since
+// clients send the credentials with every request, successful
+// verifications are cached for a while.
+func basicAuthUser(r *http.Request, user string, pass string) string {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if ip != "" && bruteforce.Banned(ip) {
+		log.Println("basic authentication refused for banned IP " + ip)
+		return ""
+	}
+	// the stored hash is part of the key: changing the password
+	// invalidates the cached verification
+	cacheKey := mutils.HashToken(user + "\x00" + pass + "\x00" + state().users[user])
+	if basicAuthCached(cacheKey) {
+		return user
+	}
+	if !authenticate(ip, user, pass) {
+		return ""
+	}
+	cacheBasicAuth(cacheKey)
+	return user
+}
+
+// basicAuthCached returns true when the credentials with the given
+// cache key have been verified recently.
+func basicAuthCached(cacheKey string) bool {
+	basicAuthCacheMutex.Lock()
+	expiry, found := basicAuthCache[cacheKey]
+	basicAuthCacheMutex.Unlock()
+	return found && time.Now().Before(expiry)
+}
+
+// cacheBasicAuth records a successful Basic authentication. The expired
+// entries are removed, and when the cache is full the entry expiring
+// first leaves room for the new one.
+func cacheBasicAuth(cacheKey string) {
+	basicAuthCacheMutex.Lock()
+	defer basicAuthCacheMutex.Unlock()
+	now := time.Now()
+	for k, expiry := range basicAuthCache {
+		if !now.Before(expiry) {
+			delete(basicAuthCache, k)
+		}
+	}
+	if len(basicAuthCache) >= basicAuthCacheSize {
+		var first string
+		for k, expiry := range basicAuthCache {
+			if first == "" || expiry.Before(basicAuthCache[first]) {
+				first = k
+			}
+		}
+		delete(basicAuthCache, first)
+	}
+	basicAuthCache[cacheKey] = now.Add(basicAuthCacheTime)
+}
+
+// isBrowser returns true when the request comes from a web browser,
+// that is when the client accepts HTML pages.
+func isBrowser(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// denyAccess answers a request for a private resource the user is not
+// allowed to get: browsers get the login form, other clients (wget,
+// curl, scripts) get 401 asking for Basic authentication, or 403 if
+// they are already authenticated.
+func denyAccess(w http.ResponseWriter, r *http.Request, username string) {
+	if isBrowser(r) && !wantsJson(r) {
+		webloginform(w, r, username)
+		return
+	}
+	status := http.StatusForbidden
+	if username == "" {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"httpiccolo\", charset=\"UTF-8\"")
+		status = http.StatusUnauthorized
+	}
+	message := "access denied for user \"" + username + "\""
+	if wantsJson(r) {
+		writeJsonError(w, status, message)
+	} else {
+		w.WriteHeader(status)
+		fmt.Fprintln(w, message)
+	}
 }
@@ -0,0 +1,83 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogout(t *testing.T) {
+	newTestState(t)
+	cookies := login(t, "bob", testPasswords["bob"], "10.0.0.2")
+	loggedIn := func() bool {
+		response := serve(http.MethodGet, "/priv/file.txt", nil, "10.0.0.2", cookies)
+		return strings.Contains(responseBody(response), "content of /priv")
+	}
+	if !loggedIn() {
+		t.Fatal("bob cannot read /priv after the login")
+	}
+	m := csrfTokenPattern.FindStringSubmatch(responseBody(serve(http.MethodGet, "/pub", nil, "10.0.0.2", cookies)))
+	if m == nil {
+		t.Fatal("no CSRF token in the logout form")
+	}
+
+	// links and forms of other sites cannot log the user out
+	if response := serve(http.MethodGet, "/logout", nil, "10.0.0.2", cookies); response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /logout: status %d, expected %d", response.StatusCode, http.StatusMethodNotAllowed)
+	}
+	if response := serve(http.MethodPost, "/logout", url.Values{"csrf_token": {"0123"}}, "10.0.0.2", cookies); response.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /logout with a wrong token: status %d, expected %d", response.StatusCode, http.StatusForbidden)
+	}
+	if !loggedIn() {
+		t.Fatal("bob was logged out without the CSRF token")
+	}
+
+	serve(http.MethodPost, "/logout", url.Values{"csrf_token": {m[1]}}, "10.0.0.2", cookies)
+	if loggedIn() {
+		t.Error("bob is still logged in after the logout")
+	}
+}
+
+func TestBasicAuthCacheBounded(t *testing.T) {
+	basicAuthCacheMutex.Lock()
+	basicAuthCache = map[string]time.Time{"expired": time.Now().Add(-time.Second)}
+	basicAuthCacheMutex.Unlock()
+	for i := 0; i < basicAuthCacheSize+10; i++ {
+		cacheBasicAuth("key" + strconv.Itoa(i))
+	}
+	basicAuthCacheMutex.Lock()
+	size := len(basicAuthCache)
+	_, expired := basicAuthCache["expired"]
+	basicAuthCacheMutex.Unlock()
+	if size != basicAuthCacheSize {
+		t.Errorf("%d cached authentications, the limit is %d", size, basicAuthCacheSize)
+	}
+	if expired {
+		t.Error("the expired authentication was not removed")
+	}
+	if !basicAuthCached("key" + strconv.Itoa(basicAuthCacheSize+9)) {
+		t.Error("the last authentication is not cached")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"marcellozaniboni.net/httpiccolo/mmarkdown"
+	"marcellozaniboni.net/httpiccolo/mstatic"
+	"marcellozaniboni.net/httpiccolo/mutils"
+)
+
+// maxMarkdownSize is the size of the largest Markdown file rendered
+// as HTML; the larger ones are served as they are
+const maxMarkdownSize int64 = 1024 * 1024
+
+// markdownRendered returns true when a file must be rendered as HTML:
+// Markdown files are, unless the link asks for the raw file or for
+// downloading it, or the extension must always be downloaded.
+func markdownRendered(r *http.Request, info os.FileInfo) bool {
+	ext := mutils.FileExtension(info.Name())
+	if ext != "md" && ext != "markdown" {
+		return false
+	}
+	if r.Form.Get("raw") != "" || r.Form.Get("download") != "" || info.Size() > maxMarkdownSize {
+		return false
+	}
+	return !extensionListed(info.Name(), state().configuration["download_extensions"])
+}
+
+// webmarkdown shows a Markdown file rendered as HTML, with the links
+// to the directory and to the original file.
+func webmarkdown(w http.ResponseWriter, r *http.Request, username string, isAdmin bool, httppath string, resourcepath string) {
+	source, err := readMarkdown(resourcepath)
+	if err != nil {
+		fmt.Fprintln(w, "error while reading file, please report to the administrator")
+		log.Print("error while reading file "+resourcepath, err)
+		return
+	}
+	log.Print("rendering: \"" + httppath + "\"")
+	directory := path.Dir(httppath)
+	fileurl := (&url.URL{Path: httppath}).EscapedPath()
+	fmt.Fprintln(w, browsingHeader(w, r, html.EscapeString(path.Base(httppath)), username, isAdmin))
+	links := strings.Replace(mstatic.HtmlRenderedFileLinks, "[directory_url]", html.EscapeString((&url.URL{Path: directory}).EscapedPath()), 1)
+	links = strings.Replace(links, "[raw_url]", html.EscapeString(fileurl+"?raw=1"), 1)
+	links = strings.Replace(links, "[download_url]", html.EscapeString(fileurl+"?download=1"), 1)
+	fmt.Fprintln(w, links)
+	fmt.Fprintln(w, mstatic.HtmlMarkdownBegin)
+	fmt.Fprintln(w, renderMarkdown(source, directory, username))
+	fmt.Fprintln(w, mstatic.HtmlMarkdownEnd)
+	fmt.Fprintln(w, mstatic.HtmlFooter)
+}
+
+// writeReadme writes the README.md of a directory under its listing.
+func writeReadme(w io.Writer, username string, httppath string, resourcepath string) {
+	source, err := readMarkdown(resourcepath)
+	if err != nil {
+		log.Print("error while reading file "+resourcepath, err)
+		return
+	}
+	fmt.Fprintln(w, mstatic.HtmlReadmeTitle)
+	fmt.Fprintln(w, mstatic.HtmlMarkdownBegin)
+	fmt.Fprintln(w, renderMarkdown(source, httppath, username))
+	fmt.Fprintln(w, mstatic.HtmlMarkdownEnd)
+}
+
+// readMarkdown reads a Markdown file, up to maxMarkdownSize bytes.
+func readMarkdown(resourcepath string) ([]byte, error) {
+	file, err := os.Open(resourcepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, maxMarkdownSize))
+}
+
+// renderMarkdown renders a Markdown file contained in the web directory
+// dirpath. Relative links and images are resolved against dirpath, and
+// they are removed when they point to paths the user cannot read.
+func renderMarkdown(source []byte, dirpath string, username string) string {
+	return mmarkdown.ToHtml(string(source), func(destination string, image bool) (string, bool) {
+		target, suffix := destination, ""
+		if k := strings.IndexAny(target, "?#"); k >= 0 {
+			target, suffix = target[:k], target[k:]
+		}
+		target, err := url.PathUnescape(target)
+		if err != nil {
+			return "", false
+		}
+		if !strings.HasPrefix(target, "/") {
+			target = dirpath + "/" + target
+		}
+		// ".." is fine in a link, but it cannot go above the root
+		httppath, _, ok := resolveWebPath(path.Clean("/" + target))
+		if !ok {
+			return "", false
+		}
+		if isPrivate, readAllowed := readGrant(username, httppath); isPrivate && !readAllowed {
+			return "", false
+		}
+		if httppath == "" {
+			httppath = "/"
+		}
+		return (&url.URL{Path: httppath}).EscapedPath() + suffix, true
+	})
+}
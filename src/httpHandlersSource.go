@@ -0,0 +1,103 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"marcellozaniboni.net/httpiccolo/mstatic"
+	"marcellozaniboni.net/httpiccolo/msyntax"
+	"marcellozaniboni.net/httpiccolo/mutils"
+)
+
+// maxSourceViewSize is the size of the largest source file shown with
+// syntax highlighting; the larger ones are served as they are
+const maxSourceViewSize int64 = 1024 * 1024
+
+// sourceViewed returns true when a file must be shown in the source
+// viewer: files with the extension of a known language are, unless the
+// link asks for the raw file or for downloading it, the file is too
+// large, or the extension must always be downloaded.
+func sourceViewed(r *http.Request, info os.FileInfo) bool {
+	if msyntax.LanguageOf(mutils.FileExtension(info.Name())) == nil {
+		return false
+	}
+	if r.Form.Get("raw") != "" || r.Form.Get("download") != "" || info.Size() > maxSourceViewSize {
+		return false
+	}
+	return !extensionListed(info.Name(), state().configuration["download_extensions"])
+}
+
+// websource shows a source file with line numbers and syntax
+// highlighting; every line has an anchor (e.g. #L42) for linking it.
+func websource(w http.ResponseWriter, r *http.Request, username string, isAdmin bool, httppath string, resourcepath string, info os.FileInfo) {
+	source, err := os.ReadFile(resourcepath)
+	if err != nil {
+		fmt.Fprintln(w, "error while reading file, please report to the administrator")
+		log.Print("error while reading file "+resourcepath, err)
+		return
+	}
+	// binary files with a source extension are served as they are
+	if bytes.IndexByte(source, 0) >= 0 {
+		serveFile(w, r, resourcepath, info)
+		return
+	}
+	log.Print("source view: \"" + httppath + "\"")
+	language := msyntax.LanguageOf(mutils.FileExtension(info.Name()))
+	lines := msyntax.Highlight(decodeText(source), language)
+
+	fileurl := (&url.URL{Path: httppath}).EscapedPath()
+	fmt.Fprintln(w, browsingHeader(w, r, html.EscapeString(path.Base(httppath)), username, isAdmin))
+	links := strings.Replace(mstatic.HtmlRenderedFileLinks, "[directory_url]", html.EscapeString((&url.URL{Path: path.Dir(httppath)}).EscapedPath()), 1)
+	links = strings.Replace(links, "[raw_url]", html.EscapeString(fileurl+"?raw=1"), 1)
+	links = strings.Replace(links, "[download_url]", html.EscapeString(fileurl+"?download=1"), 1)
+	fmt.Fprintln(w, links)
+	fmt.Fprintln(w, "<p><small>"+language.Name+", "+strconv.Itoa(len(lines))+" lines, "+mutils.FormatFileSize(info.Size())+"</small></p>")
+	fmt.Fprintln(w, mstatic.HtmlSourceBegin)
+	for i, line := range lines {
+		fmt.Fprintln(w, mstatic.GetHtmlSourceLine(i+1, line))
+	}
+	fmt.Fprintln(w, mstatic.HtmlSourceEnd)
+	fmt.Fprintln(w, mstatic.HtmlFooter)
+}
+
+// decodeText returns the text of a file: UTF-8, or ISO-8859-1 when it
+// is not valid UTF-8.
+func decodeText(content []byte) string {
+	content = bytes.TrimPrefix(content, []byte{0xEF, 0xBB, 0xBF})
+	if utf8.Valid(content) {
+		return string(content)
+	}
+	runes := make([]rune, len(content))
+	for i, b := range content {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
@@ -0,0 +1,152 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"marcellozaniboni.net/httpiccolo/bruteforce"
+	"marcellozaniboni.net/httpiccolo/mdao"
+	"marcellozaniboni.net/httpiccolo/mstatic"
+	"marcellozaniboni.net/httpiccolo/mutils"
+)
+
+// apiTokenBytes is the number of random bytes of an API token
+const apiTokenBytes int = 32
+
+// apiTokenIdLength is the length of the id identifying a token
+const apiTokenIdLength int = 12
+
+// bearerToken returns the token sent in the Authorization header,
+// and true if the header contains a bearer token.
+func bearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+		return strings.TrimSpace(authorization[7:]), true
+	}
+	return "", false
+}
+
+// tokenUser returns the username an API token belongs to, or "" if
+// the token is not valid. Invalid tokens count as failed logins.
+func tokenUser(r *http.Request, token string) string {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if ip != "" && bruteforce.Banned(ip) {
+		log.Println("API token refused for banned IP " + ip)
+		return ""
+	}
+	hash := mutils.HashToken(token)
+	st := state()
+	for _, t := range st.tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) == 1 {
+			if _, found := st.users[t.Username]; found {
+				return t.Username
+			}
+		}
+	}
+	if ip != "" {
+		bruteforce.RecordFailedLogin(ip)
+	}
+	log.Println("invalid API token from IP \""+ip+"\", banned =", bruteforce.Banned(ip))
+	return ""
+}
+
+// revokeUserTokens deletes all the API tokens of a user from the state
+// s and returns how many tokens were deleted.
+func revokeUserTokens(s *appState, username string) int {
+	revoked := 0
+	for id, t := range s.tokens {
+		if t.Username == username {
+			delete(s.tokens, id)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+func webnewtokenaction(w http.ResponseWriter, r *http.Request) {
+	username, isAdmin := verifyLoggedUser(w, r)
+	if !isAdmin {
+		// login needed
+		log.Println("new token action, access denied for user \"" + username + "\"")
+		fmt.Fprintln(w, "access denied for user \""+username+"\"")
+		return
+	}
+	if !verifyAdminPost(w, r, "new token") {
+		return
+	}
+	r.ParseForm()
+	u := r.Form.Get("new_token_usr")
+	description := r.Form.Get("new_token_description")
+	log.Println("admin page - new token for user \"" + u + "\", description \"" + description + "\"")
+	if _, found := state().users[u]; !found {
+		log.Println("admin page - new token action - error: user \"" + u + "\" not found")
+		fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new API token", false, restartneeded.Load(), false))
+		fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+state().configuration["admin_path"]))
+		fmt.Fprintln(w, mstatic.HtmlFooter)
+		return
+	}
+	token := mutils.RandomToken(apiTokenBytes)
+	id := mutils.RandomToken(apiTokenIdLength / 2)
+	updateState(func(s *appState) {
+		s.tokens[id] = mdao.JsonToken{
+			Id:          id,
+			Username:    u,
+			Hash:        mutils.HashToken(token),
+			Description: description,
+			Created:     time.Now().Format("2006-01-02 15:04:05"),
+		}
+		mdao.WriteTokensJson(configpath, s.tokens)
+	})
+	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - new API token", false, restartneeded.Load(), false))
+	fmt.Fprintln(w, mstatic.GetHtmlNewToken(token, "/"+state().configuration["admin_path"]+"?nonache="+mutils.RandomId(noCacheIdLength)))
+	fmt.Fprintln(w, mstatic.HtmlFooter)
+}
+
+func webrevoketokenaction(w http.ResponseWriter, r *http.Request) {
+	username, isAdmin := verifyLoggedUser(w, r)
+	if !isAdmin {
+		// login needed
+		log.Println("revoke token action, access denied for user \"" + username + "\"")
+		fmt.Fprintln(w, "access denied for user \""+username+"\"")
+		return
+	}
+	if !verifyAdminPost(w, r, "revoke token") {
+		return
+	}
+	r.ParseForm()
+	id := r.Form.Get("revoke_token_id")
+	log.Println("admin page - revoke token \"" + id + "\"")
+	updateState(func(s *appState) {
+		if _, found := s.tokens[id]; found {
+			delete(s.tokens, id)
+			mdao.WriteTokensJson(configpath, s.tokens)
+		}
+	})
+	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - settings - revoking API token", false, restartneeded.Load(), false))
+	fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction("/"+state().configuration["admin_path"]))
+	fmt.Fprintln(w, mstatic.HtmlFooter)
+}
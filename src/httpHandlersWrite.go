@@ -0,0 +1,441 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"marcellozaniboni.net/httpiccolo/mstatic"
+	"marcellozaniboni.net/httpiccolo/mutils"
+)
+
+// defaultMaxUploadMiB is used when max_upload_mb is not configured
+const defaultMaxUploadMiB int64 = 1024
+
+// uploadTempPrefix is the name prefix of the files being uploaded;
+// these files are not shown in directory listings.
+const uploadTempPrefix string = ".httpiccolo-upload-"
+
+// maxUploadSize returns the maximum size in bytes of an upload request.
+func maxUploadSize() int64 {
+	maxUpload, err := strconv.ParseInt(state().configuration["max_upload_mb"], 10, 64)
+	if err != nil || maxUpload < 1 {
+		maxUpload = defaultMaxUploadMiB
+	}
+	return maxUpload * 1024 * 1024
+}
+
+// validFileName returns true if name can be used as the name of a
+// new file or directory inside the current one.
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\\x00") && !strings.HasPrefix(name, uploadTempPrefix)
+}
+
+// webuploadaction receives one or more files from the upload form of a
+// directory listing. The files are streamed to temporary files in the
+// destination directory and then renamed, so that incomplete uploads
+// never appear with their final name.
+func webuploadaction(w http.ResponseWriter, r *http.Request) {
+	username, _ := verifyLoggedUser(w, r)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "method not allowed")
+		return
+	}
+
+	// the directory is in the query string, so it can be checked before
+	// reading the request body
+	httppath, resourcepath, ok := resolveWebPath(r.URL.Query().Get("directory"))
+	if !ok {
+		log.Println("upload action: invalid directory \"" + r.URL.Query().Get("directory") + "\" from user \"" + username + "\"")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, mstatic.ErrNoContent)
+		return
+	}
+	isPrivate, readAllowed := readGrant(username, httppath)
+	if (isPrivate && !readAllowed) || !writeGrant(username, httppath) {
+		log.Println("upload action: access denied for user \"" + username + "\" to \"" + httppath + "\"")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "access denied for user \""+username+"\"")
+		return
+	}
+	if info, err := os.Stat(resourcepath); err != nil || !info.IsDir() {
+		log.Println("upload action: directory not found \"" + resourcepath + "\"")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, mstatic.ErrNoContent)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize())
+	reader, err := r.MultipartReader()
+	if err != nil {
+		log.Println("upload action: bad request from user \""+username+"\":", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "bad upload request")
+		return
+	}
+
+	var results []string
+	overwrite := false
+	// the CSRF token is a form field preceding the files, it must be
+	// checked before saving any of them
+	_, csrfChecked := bearerToken(r)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println("upload action: error reading the request:", err)
+			results = append(results, uploadErrorMessage(err))
+			break
+		}
+		if part.FileName() == "" {
+			// form fields must precede the files
+			if part.FormName() == "overwrite" {
+				value, _ := io.ReadAll(io.LimitReader(part, 16))
+				overwrite = string(value) == "on"
+			} else if part.FormName() == csrfTokenField {
+				value, _ := io.ReadAll(io.LimitReader(part, 128))
+				if !verifyCsrfToken(w, r, "upload", string(value)) {
+					part.Close()
+					return
+				}
+				csrfChecked = true
+			}
+			part.Close()
+			continue
+		}
+		if !csrfChecked {
+			part.Close()
+			verifyCsrfToken(w, r, "upload", "")
+			return
+		}
+		name := path.Base(mutils.BackToForwardSlashes(part.FileName()))
+		message, err := saveUploadedFile(part, resourcepath, name, overwrite)
+		part.Close()
+		if err != nil {
+			log.Println("upload action: user \""+username+"\", file \""+httppath+"/"+name+"\":", err)
+		} else {
+			log.Println("upload action: user \"" + username + "\" uploaded \"" + httppath + "/" + name + "\"")
+		}
+		results = append(results, html.EscapeString(name)+": "+message)
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			break
+		}
+	}
+
+	// the URL is written into a script, so it must be escaped
+	redirectUrl := (&url.URL{Path: httppath}).EscapedPath()
+	if redirectUrl == "" {
+		redirectUrl = "/"
+	}
+	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - upload", false, restartneeded.Load(), false))
+	fmt.Fprintln(w, "<ul>")
+	for _, result := range results {
+		fmt.Fprintln(w, "<li>"+result+"</li>")
+	}
+	fmt.Fprintln(w, "</ul>")
+	fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction(redirectUrl+"?nocache="+mutils.RandomId(noCacheIdLength)))
+	fmt.Fprintln(w, mstatic.HtmlFooter)
+}
+
+// saveUploadedFile copies an uploaded file into a temporary file inside
+// directory and then renames it. It returns a message for the user.
+func saveUploadedFile(src io.Reader, directory string, name string, overwrite bool) (string, error) {
+	if !validFileName(name) {
+		return "invalid file name", errors.New("invalid file name")
+	}
+	destination := directory + "/" + name
+	if info, err := os.Stat(destination); err == nil {
+		if info.IsDir() {
+			return "a directory with the same name exists", errors.New("destination is a directory")
+		}
+		if !overwrite {
+			return "file already exists (not overwritten)", errors.New("destination exists")
+		}
+	}
+	tmp, err := os.CreateTemp(directory, uploadTempPrefix+"*")
+	if err != nil {
+		return "cannot write into the directory", err
+	}
+	written, err := io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), destination)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return uploadErrorMessage(err), err
+	}
+	return "uploaded (" + mutils.FormatFileSize(written) + ")", nil
+}
+
+// uploadErrorMessage returns a message for the user explaining an
+// upload error.
+func uploadErrorMessage(err error) string {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return "upload too large, the maximum size is " + mutils.FormatFileSize(maxUploadSize())
+	}
+	return "upload failed"
+}
+
+// webmkdiraction creates a new directory inside a writable directory.
+func webmkdiraction(w http.ResponseWriter, r *http.Request) {
+	username, ok := startWriteAction(w, r, "mkdir")
+	if !ok {
+		return
+	}
+	httppath, resourcepath, ok := resolveWebPath(r.PostForm.Get("directory"))
+	name := r.PostForm.Get("name")
+	var message string
+	if !ok || !userCanModify(username, httppath, true) {
+		message = writeActionDenied("mkdir", username, r.PostForm.Get("directory"))
+	} else if !validFileName(name) {
+		message = "invalid directory name"
+	} else if err := os.Mkdir(resourcepath+"/"+name, 0755); err != nil {
+		log.Println("mkdir action: user \""+username+"\", directory \""+httppath+"/"+name+"\":", err)
+		message = "cannot create the directory (" + writeErrorReason(err) + ")"
+	} else {
+		log.Println("mkdir action: user \"" + username + "\" created \"" + httppath + "/" + name + "\"")
+		message = "directory created"
+	}
+	writeActionResponse(w, "new directory", html.EscapeString(name)+": "+message, httppath)
+}
+
+// webrenameaction renames a file or a directory; the new name must be
+// a simple name, use webmoveaction to change the directory.
+func webrenameaction(w http.ResponseWriter, r *http.Request) {
+	username, ok := startWriteAction(w, r, "rename")
+	if !ok {
+		return
+	}
+	httppath, resourcepath, ok := resolveWebPath(r.PostForm.Get("path"))
+	name := r.PostForm.Get("name")
+	parent := parentWebPath(httppath)
+	var message string
+	if !ok || httppath == "" || !userCanModify(username, httppath, false) {
+		message = writeActionDenied("rename", username, r.PostForm.Get("path"))
+	} else if !validFileName(name) {
+		message = "invalid name"
+	} else if protectedByPermissions(httppath) {
+		message = "the directory contains private or writable directories; ask the administrator"
+	} else if _, err := os.Stat(rootDirectory() + parent + "/" + name); err == nil {
+		message = "the name \"" + html.EscapeString(name) + "\" is already used"
+	} else if err := os.Rename(resourcepath, rootDirectory()+parent+"/"+name); err != nil {
+		log.Println("rename action: user \""+username+"\", \""+httppath+"\" to \""+name+"\":", err)
+		message = "cannot rename (" + writeErrorReason(err) + ")"
+	} else {
+		log.Println("rename action: user \"" + username + "\" renamed \"" + httppath + "\" to \"" + parent + "/" + name + "\"")
+		message = "renamed to \"" + html.EscapeString(name) + "\""
+	}
+	writeActionResponse(w, "rename", html.EscapeString(httppath)+": "+message, parent)
+}
+
+// webmoveaction moves a file or a directory into another directory;
+// the user must be allowed to write into both the directories.
+func webmoveaction(w http.ResponseWriter, r *http.Request) {
+	username, ok := startWriteAction(w, r, "move")
+	if !ok {
+		return
+	}
+	httppath, resourcepath, ok := resolveWebPath(r.PostForm.Get("path"))
+	destination, destinationpath, destinationOk := resolveWebPath(r.PostForm.Get("destination"))
+	parent := parentWebPath(httppath)
+	name := path.Base(httppath)
+	var message string
+	if !ok || httppath == "" || !userCanModify(username, httppath, false) {
+		message = writeActionDenied("move", username, r.PostForm.Get("path"))
+	} else if !destinationOk || !userCanModify(username, destination, true) {
+		message = writeActionDenied("move", username, r.PostForm.Get("destination"))
+	} else if destination == httppath || strings.HasPrefix(destination, httppath+"/") {
+		message = "a directory cannot be moved into itself"
+	} else if protectedByPermissions(httppath) {
+		message = "the directory contains private or writable directories; ask the administrator"
+	} else if info, err := os.Stat(destinationpath); err != nil || !info.IsDir() {
+		message = "the destination directory does not exist"
+	} else if _, err := os.Stat(destinationpath + "/" + name); err == nil {
+		message = "the destination directory already contains \"" + html.EscapeString(name) + "\""
+	} else if err := os.Rename(resourcepath, destinationpath+"/"+name); err != nil {
+		log.Println("move action: user \""+username+"\", \""+httppath+"\" to \""+destination+"\":", err)
+		message = "cannot move (" + writeErrorReason(err) + ")"
+	} else {
+		log.Println("move action: user \"" + username + "\" moved \"" + httppath + "\" to \"" + destination + "/" + name + "\"")
+		message = "moved to \"" + html.EscapeString(destination+"/") + "\""
+	}
+	writeActionResponse(w, "move", html.EscapeString(httppath)+": "+message, parent)
+}
+
+// webdeleteaction deletes a file or an empty directory.
+func webdeleteaction(w http.ResponseWriter, r *http.Request) {
+	username, ok := startWriteAction(w, r, "delete")
+	if !ok {
+		return
+	}
+	httppath, resourcepath, ok := resolveWebPath(r.PostForm.Get("path"))
+	parent := parentWebPath(httppath)
+	var message string
+	if !ok || httppath == "" || !userCanModify(username, httppath, false) {
+		message = writeActionDenied("delete", username, r.PostForm.Get("path"))
+	} else if protectedByPermissions(httppath) {
+		message = "the directory is private or writable; ask the administrator"
+	} else if err := os.Remove(resourcepath); err != nil {
+		// os.Remove refuses to delete directories that are not empty
+		log.Println("delete action: user \""+username+"\", \""+httppath+"\":", err)
+		message = "cannot delete (" + writeErrorReason(err) + ")"
+	} else {
+		log.Println("delete action: user \"" + username + "\" deleted \"" + httppath + "\"")
+		message = "deleted"
+	}
+	writeActionResponse(w, "delete", html.EscapeString(httppath)+": "+message, parent)
+}
+
+// startWriteAction identifies the user, parses the form of a write
+// action and checks its CSRF token (not needed with an API token, as in
+// verifyAdminPost); it returns false (after writing the response) when
+// the action cannot continue.
+func startWriteAction(w http.ResponseWriter, r *http.Request, action string) (string, bool) {
+	username, _ := verifyLoggedUser(w, r)
+	if r.Method != http.MethodPost {
+		log.Println(action + " action: method " + r.Method + " not allowed")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "method not allowed")
+		return username, false
+	}
+	if username == "" {
+		log.Println(action + " action: access denied for anonymous user")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "access denied for user \"\"")
+		return username, false
+	}
+	r.ParseForm()
+	if _, found := bearerToken(r); !found && !verifyCsrfToken(w, r, action, r.PostForm.Get(csrfTokenField)) {
+		return username, false
+	}
+	return username, true
+}
+
+// userCanModify checks that an item exists and that the user can read
+// it and write into its parent directory; when isDirectory is true the
+// item must be a directory and the write grant is checked on the item
+// itself (e.g. the destination of a new directory).
+func userCanModify(username string, httppath string, isDirectory bool) bool {
+	info, err := os.Stat(rootDirectory() + httppath)
+	if err != nil || (isDirectory && !info.IsDir()) {
+		return false
+	}
+	isPrivate, readAllowed := readGrant(username, httppath)
+	if isPrivate && !readAllowed {
+		return false
+	}
+	if isDirectory {
+		return writeGrant(username, httppath)
+	}
+	return writeGrant(username, parentWebPath(httppath))
+}
+
+// protectedByPermissions returns true when the item at httppath is a
+// directory configured in the permissions, or it contains one of them:
+// renaming, moving or deleting it would change the access rules.
+func protectedByPermissions(httppath string) bool {
+	st := state()
+	for _, grants := range []map[string]string{st.permissions, st.writePermissions} {
+		for directory := range grants {
+			if directory == httppath || strings.HasPrefix(directory, httppath+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parentWebPath returns the web path of the parent directory ("" for
+// the root directory).
+func parentWebPath(httppath string) string {
+	parent := path.Dir(httppath)
+	if parent == "/" || parent == "." {
+		return ""
+	}
+	return parent
+}
+
+// writeActionDenied logs a denied write action and returns the message
+// for the user.
+func writeActionDenied(action string, username string, webpath string) string {
+	log.Println(action + " action: access denied for user \"" + username + "\" to \"" + webpath + "\"")
+	return "access denied or not found"
+}
+
+// writeErrorReason returns a short explanation of a filesystem error.
+func writeErrorReason(err error) string {
+	switch {
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return "directory not empty"
+	case errors.Is(err, os.ErrExist):
+		return "already exists"
+	case errors.Is(err, os.ErrPermission):
+		return "permission denied on the server"
+	case errors.Is(err, os.ErrNotExist):
+		return "not found"
+	default:
+		var pathError *os.PathError
+		var linkError *os.LinkError
+		if errors.As(err, &pathError) {
+			return pathError.Err.Error()
+		}
+		if errors.As(err, &linkError) {
+			return linkError.Err.Error()
+		}
+		return "error"
+	}
+}
+
+// writeActionResponse writes the response page of a write action and
+// then redirects the browser to the directory listing.
+func writeActionResponse(w http.ResponseWriter, title string, message string, directory string) {
+	// the URL is written into a script, so it must be escaped
+	directoryurl := (&url.URL{Path: directory}).EscapedPath()
+	if directoryurl == "" {
+		directoryurl = "/"
+	}
+	fmt.Fprintln(w, mstatic.GetHtmlHeader("httpiccolo - "+title, false, restartneeded.Load(), false))
+	fmt.Fprintln(w, "<p>"+message+"</p>")
+	fmt.Fprintln(w, mstatic.GetHtmlCounterAfterDaoAction(directoryurl+"?nocache="+mutils.RandomId(noCacheIdLength)))
+	fmt.Fprintln(w, mstatic.HtmlFooter)
+}
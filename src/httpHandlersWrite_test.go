@@ -0,0 +1,129 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"bytes"
+	"html"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// hostileName is a file name that breaks out of the HTML attributes
+// and runs a script, when the listing does not escape it
+const hostileName = "x'><img src=x onerror=alert(1)>"
+
+// newWritableTestState creates the test state of newTestState, with
+// "/pub" writable by admin, and returns the cookies of the admin
+// session and the CSRF token of the listing of "/pub".
+func newWritableTestState(t *testing.T) ([]*http.Cookie, string) {
+	t.Helper()
+	newTestState(t)
+	updateState(func(s *appState) {
+		s.writePermissions = map[string]string{"/pub": "admin"}
+	})
+	cookies := login(t, "admin", testPasswords["admin"], "10.0.0.1")
+	m := csrfTokenPattern.FindStringSubmatch(responseBody(serve(http.MethodGet, "/pub", nil, "10.0.0.1", cookies)))
+	if m == nil {
+		t.Fatal("no CSRF token in the listing of /pub")
+	}
+	return cookies, m[1]
+}
+
+// checkListingEscapes checks that the listing of "/pub" contains the
+// hostile name only escaped.
+func checkListingEscapes(t *testing.T, cookies []*http.Cookie) {
+	t.Helper()
+	listing := responseBody(serve(http.MethodGet, "/pub", nil, "10.0.0.1", cookies))
+	if strings.Contains(listing, "<img src=x") {
+		t.Errorf("the listing contains the unescaped name %q", hostileName)
+	}
+	if !strings.Contains(listing, ">"+html.EscapeString(hostileName)) {
+		t.Errorf("the listing does not show the name %q", hostileName)
+	}
+}
+
+func TestUploadedNameEscaped(t *testing.T) {
+	cookies, csrf := newWritableTestState(t)
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("csrf_token", csrf)
+	part, _ := form.CreateFormFile("file", hostileName)
+	part.Write([]byte("content"))
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, "/upload_action?directory="+url.QueryEscape("/pub"), &body)
+	r.RemoteAddr = "10.0.0.1:40000"
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, r)
+	if _, err := os.Stat(rootDirectory() + "/pub/" + hostileName); err != nil {
+		t.Fatal("the file was not uploaded:", err)
+	}
+	if strings.Contains(w.Body.String(), "<img src=x") {
+		t.Error("the upload result contains the unescaped name")
+	}
+	checkListingEscapes(t, cookies)
+}
+
+func TestCreatedNamesEscaped(t *testing.T) {
+	cookies, csrf := newWritableTestState(t)
+	actions := []struct {
+		target string
+		form   url.Values
+	}{
+		{"/mkdir_action", url.Values{"directory": {"/pub"}, "name": {hostileName}}},
+		{"/mkdir_action", url.Values{"directory": {"/pub/" + hostileName}, "name": {"sub"}}},
+		{"/rename_action", url.Values{"path": {"/pub/file.txt"}, "name": {hostileName + ".txt"}}},
+	}
+	for _, action := range actions {
+		action.form.Set("csrf_token", csrf)
+		response := responseBody(serve(http.MethodPost, action.target, action.form, "10.0.0.1", cookies))
+		if strings.Contains(response, "<img src=x") || strings.Contains(response, "\"/pub/"+hostileName) {
+			t.Errorf("the response of %s contains the unescaped name: %s", action.target, response)
+		}
+	}
+	for _, name := range []string{hostileName + "/sub", hostileName + ".txt"} {
+		if _, err := os.Stat(rootDirectory() + "/pub/" + name); err != nil {
+			t.Fatal("the write actions failed:", err)
+		}
+	}
+	checkListingEscapes(t, cookies)
+
+	// the administrator chooses among all the directory names
+	form := responseBody(serve(http.MethodGet, "/admin/new_perm_form", nil, "10.0.0.1", cookies))
+	if strings.Contains(form, "<img src=x") || !strings.Contains(form, html.EscapeString(hostileName)) {
+		t.Error("the new permission form does not escape the directory names")
+	}
+	updateState(func(s *appState) {
+		s.permissions = map[string]string{"/pub/" + hostileName: "bob"}
+	})
+	admin := responseBody(serve(http.MethodGet, "/admin", nil, "10.0.0.1", cookies))
+	if strings.Contains(admin, "<img src=x") || !strings.Contains(admin, html.EscapeString(hostileName)) {
+		t.Error("the permission table does not escape the directory names")
+	}
+}
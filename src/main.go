@@ -25,13 +25,17 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/term"
 	"marcellozaniboni.net/httpiccolo/mdao"
+	"marcellozaniboni.net/httpiccolo/msession"
 	"marcellozaniboni.net/httpiccolo/mstatic"
 	"marcellozaniboni.net/httpiccolo/mutils"
 )
@@ -42,65 +46,113 @@ const httpiccoloVersion string = "0.9"
 // this is used for version checking
 const httpiccoloProductId string = "5d72b94e-255f-48d9-b2a9-0d3d2ef97df5"
 
-// configuration contains the main configuration
-var configuration map[string]string
-
-// users contains a username-password map for configured users
-var users map[string]string
-
-// permissions contains a directory-userlist map for restricted access control
-var permissions map[string]string
-
 // configpath directory contains the json files where configuration is stored
 var configpath string
 
-// restartneeded true means that the system complains untill restarted
-var restartneeded bool = false
+// restartneeded true means that the system complains untill restarted:
+// some settings saved from the admin console cannot be applied live
+var restartneeded atomic.Bool
 
 // userDefinedConfigDir is true when -c command line argument is used
 var userDefinedConfigDir = false
 
+// newServeMux returns the handler of the main server: the ServeMux
+// cleans the request paths (e.g. "/pub/../priv" is redirected to
+// "/priv") before they reach httpGenaralHandler.
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", httpGenaralHandler)
+	return mux
+}
+
 // httpGenaralHandler handles all the requests
 func httpGenaralHandler(w http.ResponseWriter, r *http.Request) {
 	httppath := r.URL.Path
+	// the paths are already cleaned by the ServeMux, this is a last
+	// line of defence against the requests escaping the root directory
+	if _, _, ok := resolveWebPath(httppath); !ok {
+		log.Println("invalid request path \"" + httppath + "\"")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, mstatic.ErrNoContent)
+		return
+	}
 	switch httppath {
 
 	////**** Admin web pages and actions ****////
 	// display the administrator console
-	case "/" + configuration["admin_path"]:
+	case "/" + state().configuration["admin_path"]:
 		webadminconsole(w, r)
 	// action for saving configuration
-	case "/" + configuration["admin_path"] + "/save_config":
+	case "/" + state().configuration["admin_path"] + "/save_config":
 		websaveconfigurationaction(w, r)
 	// action for changing the password to a single username
-	case "/" + configuration["admin_path"] + "/change_password":
+	case "/" + state().configuration["admin_path"] + "/change_password":
 		webchangepasswordaction(w, r)
 	// action for new user creation
-	case "/" + configuration["admin_path"] + "/new_user":
+	case "/" + state().configuration["admin_path"] + "/new_user":
 		webnewuseraction(w, r)
 	// web page for configuring a new user
-	case "/" + configuration["admin_path"] + "/new_user_form":
+	case "/" + state().configuration["admin_path"] + "/new_user_form":
 		webnewuserform(w, r)
 	// action for deleting a user
-	case "/" + configuration["admin_path"] + "/delete_user":
+	case "/" + state().configuration["admin_path"] + "/delete_user":
 		webdeleteuseraction(w, r)
+	// action for terminating all the sessions of a user
+	case "/" + state().configuration["admin_path"] + "/logout_user":
+		weblogoutuseraction(w, r)
 	// action for new permission
-	case "/" + configuration["admin_path"] + "/new_perm":
+	case "/" + state().configuration["admin_path"] + "/new_perm":
 		webnewpermaction(w, r)
 	// web page for configuring a new permission
-	case "/" + configuration["admin_path"] + "/new_perm_form":
+	case "/" + state().configuration["admin_path"] + "/new_perm_form":
 		webnewpermform(w, r)
 	// action for changing the userlist to a single permission
-	case "/" + configuration["admin_path"] + "/change_perm":
+	case "/" + state().configuration["admin_path"] + "/change_perm":
 		webchangepermaction(w, r)
 	// action for deleting a single permission
-	case "/" + configuration["admin_path"] + "/delete_perm":
+	case "/" + state().configuration["admin_path"] + "/delete_perm":
 		webdeleteperm(w, r)
+	// action for creating a new API token
+	case "/" + state().configuration["admin_path"] + "/new_token":
+		webnewtokenaction(w, r)
+	// action for revoking an API token
+	case "/" + state().configuration["admin_path"] + "/revoke_token":
+		webrevoketokenaction(w, r)
 	// action called by the login form
 
 	////**** Login ****////
 	case "/login_action":
 		webloginaction(w, r)
+	// logout: the session is terminated
+	case "/logout":
+		weblogoutaction(w, r)
+
+	////**** Archives ****////
+	// zip or tar.gz archive of directories and files
+	case "/download_archive":
+		webarchivedownload(w, r)
+
+	////**** Gallery ****////
+	// thumbnail of an image
+	case "/thumbnail":
+		webthumbnail(w, r)
+
+	////**** Write actions ****////
+	// upload of one or more files into a directory
+	case "/upload_action":
+		webuploadaction(w, r)
+	// creation of a new directory
+	case "/mkdir_action":
+		webmkdiraction(w, r)
+	// renaming of a file or a directory
+	case "/rename_action":
+		webrenameaction(w, r)
+	// moving of a file or a directory into another directory
+	case "/move_action":
+		webmoveaction(w, r)
+	// deletion of a file or an empty directory
+	case "/delete_action":
+		webdeleteaction(w, r)
 
 	////**** Favicon management ****////
 	case "/favicon.ico":
@@ -131,6 +183,28 @@ func httpGenaralHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// configurationDirectory returns the configuration directory: the
+// value of the -c argument, or "settings" in the directory of the
+// executable when it is empty.
+func configurationDirectory(userDefined string) string {
+	if userDefined == "" {
+		// default path
+		exepath, err := filepath.Abs(filepath.Dir(os.Args[0]))
+		if err != nil {
+			mutils.FatalError("fatal error", err)
+		}
+		exepath = mutils.BackToForwardSlashes(exepath)
+		return exepath + "/settings"
+	}
+	// user-defined configuration directory
+	directory := mutils.BackToForwardSlashes(userDefined)
+	for strings.HasSuffix(directory, "/") {
+		// trimming the ending slashes from path
+		directory = directory[0:(len(directory) - 1)]
+	}
+	return directory
+}
+
 func showLicenseTerms() {
 	fmt.Println(` This program is free software; you can redistribute it and/or
  modify it under the terms of the GNU General Public License as
@@ -149,15 +223,26 @@ func showLicenseTerms() {
 }
 
 func main() {
-	fmt.Print(terminalTitle)
-
 	configpathPtr := flag.String("c", "", "use a custom configuration directory\nif it doesn't exist, it will be created\nif it exists, it must already contain config files")
 	licensePtr := flag.Bool("l", false, "show license terms and exit")
 	checkNewVersionPtr := flag.Bool("v", false, "check for a new version")
 	// printConfigPtr := flag.Bool("p", false, "print current configuration and exit")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: httpiccolo [options] [command]")
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output(), commandsUsage)
+	}
 
 	flag.Parse()
 
+	// commands are meant for scripts: no title, no pauses
+	if flag.NArg() > 0 {
+		runCommand(*configpathPtr, flag.Args())
+		return
+	}
+
+	fmt.Print(terminalTitle)
+
 	if *licensePtr {
 		showLicenseTerms()
 		time.Sleep(2 * time.Second)
@@ -195,27 +280,15 @@ func main() {
 	}
 
 	// check for configuration directory
-	if *configpathPtr == "" {
-		// default path
-		exepath, err := filepath.Abs(filepath.Dir(os.Args[0]))
-		if err != nil {
-			mutils.FatalError("fatal error", err)
-		}
-		exepath = mutils.BackToForwardSlashes(exepath)
-		configpath = exepath + "/settings"
-	} else {
-		// user-defined configuration directory
-		userDefinedConfigDir = true
-		configpath = *configpathPtr
-		configpath = mutils.BackToForwardSlashes(configpath)
-		for strings.HasSuffix(configpath, "/") {
-			// trimming the ending slashes from path
-			configpath = configpath[0:(len(configpath) - 1)]
-		}
-	}
+	configpath = configurationDirectory(*configpathPtr)
+	userDefinedConfigDir = *configpathPtr != ""
 	finfo, err := os.Stat(configpath)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				// the wizard would wait for answers forever
+				mutils.FatalMessage("error: the configuration directory \"" + configpath + "\" does not exist;\nrun \"httpiccolo init -h\" to see how to create it without questions")
+			}
 			configWizard(configpath)
 		} else {
 			mutils.FatalError("error while checking configuration directory \""+configpath+"\"", err)
@@ -232,17 +305,64 @@ func main() {
 	}
 
 	// load configuration
-	configuration = mdao.ReadGeneralParameters(configpath)
-	users = mdao.ReadUsers(configpath)
-	permissions = mdao.ReadPermissions(configpath)
+	configuration := mdao.ReadGeneralParameters(configpath)
+	permissions, writePermissions := mdao.ReadPermissions(configpath)
+	setState(&appState{
+		configuration:    configuration,
+		users:            mdao.ReadUsers(configpath),
+		permissions:      permissions,
+		writePermissions: writePermissions,
+		tokens:           mdao.ReadTokens(configpath),
+	})
+
+	// sessions can optionally survive a restart
+	if configuration["session_store"] == "file" {
+		store, err := msession.NewFileStore(configpath+"/sessions.json", sessionIdleTimeout(configuration))
+		if err != nil {
+			mutils.FatalError("error while loading the sessions from \""+configpath+"/sessions.json\"", err)
+		}
+		msession.SetStore(store)
+		fileSessionsInUse = true
+	}
 
-	fmt.Println("The HTTP server has started:\n\thttp://localhost:" + configuration["http_port"] + "/")
-	fmt.Println("Administration console:\n\thttp://localhost:" + configuration["http_port"] + "/" + configuration["admin_path"] + "\n")
+	// start the server; later changes of the configuration are
+	// applied by applyConfiguration without restarting
+	if _, err := applyConfiguration(configuration); err != nil {
+		log.Fatal(err)
+	}
+	if tlsEnabled() {
+		fmt.Println("The HTTPS server has started:\n\thttps://localhost:" + configuration["http_port"] + "/")
+		fmt.Println("Administration console:\n\thttps://localhost:" + configuration["http_port"] + "/" + configuration["admin_path"] + "\n")
+		if configuration["http_redirect_port"] != "" {
+			fmt.Println("Plain HTTP requests are redirected to HTTPS from port " + configuration["http_redirect_port"] + "\n")
+		}
+	} else {
+		fmt.Println("The HTTP server has started:\n\thttp://localhost:" + configuration["http_port"] + "/")
+		fmt.Println("Administration console:\n\thttp://localhost:" + configuration["http_port"] + "/" + configuration["admin_path"] + "\n")
+	}
 
-	// start the server
-	http.HandleFunc("/", httpGenaralHandler)
-	log.Fatal(http.ListenAndServe(":"+configuration["http_port"], nil))
+	// the configuration files can be reloaded without restarting
+	go handleReloadSignal()
+	go watchConfigurationFiles()
 
+	waitForShutdown()
+}
+
+// httpsRedirectHandler answers the plain HTTP requests redirecting them
+// to the same URL on the HTTPS port.
+func httpsRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// the Host header has no port
+		host = r.Host
+	}
+	target := "https://" + host
+	if port := state().configuration["http_port"]; port != "443" {
+		target += ":" + port
+	}
+	target += r.URL.RequestURI()
+	log.Println("redirecting plain HTTP request to " + target)
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
 }
 
 const terminalTitle string = `  _     _   _         _               _
@@ -20,11 +20,14 @@ package mdao
 // 675 Mass Ave, Cambridge, MA 02139, USA.
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 )
 
 ////////////////////////
@@ -42,6 +45,16 @@ type JsonConfigList struct {
 	Params []JsonParam `json:"params"`
 }
 
+// GeneralParameterNames lists the parameters that can be defined in
+// params.json; the first four are required.
+var GeneralParameterNames = []string{
+	"root_directory", "http_port", "admin_path", "admin_users",
+	"tls_cert_file", "tls_key_file", "http_redirect_port",
+	"max_upload_mb", "session_store", "session_idle_minutes", "cookie_samesite",
+	"archive_max_mb", "archive_max_files", "inline_extensions", "download_extensions", "show_readme", "thumbnail_directory", "config_watch_seconds",
+	"read_timeout_seconds", "write_timeout_seconds", "idle_timeout_seconds", "shutdown_timeout_seconds",
+}
+
 func WriteGeneralParametersJson(path string, cfgmap map[string]string) {
 	var jcfg JsonConfigList
 	var jpar []JsonParam
@@ -74,23 +87,42 @@ func WriteGeneralParametersJson(path string, cfgmap map[string]string) {
 }
 
 func ReadGeneralParameters(configpath string) map[string]string {
-	// load the configuration
-	var cfg JsonConfigList
-
-	filename := configpath + "/params.json"
-	configfile, err := os.Open(filename)
+	configMap, err := LoadGeneralParameters(configpath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Println("The configuration directory exists, but it does not contain \"" + configpath + "/params.json\"; if you want to reset the configuration, remove the entire directory, not just its files.")
+	}
 	if err != nil {
-		log.Println("The configuration directory exists, but it does not contain \"" + filename + "\"; if you want to reset the configuration, remove the entire directory, not just its files.")
 		log.Fatal(err)
 	}
-	defer configfile.Close()
-	filecontent, err := io.ReadAll(configfile)
+	return configMap
+}
+
+// LoadGeneralParameters reads and validates params.json; unlike
+// ReadGeneralParameters, it returns the errors instead of exiting, so
+// that the configuration can be reloaded while the server is running.
+func LoadGeneralParameters(configpath string) (map[string]string, error) {
+	configMap, err := ParseGeneralParameters(configpath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if err := ValidateGeneralParameters(configMap); err != nil {
+		return nil, errors.New(err.Error() + " in " + configpath + "/params.json")
+	}
+	return configMap, nil
+}
+
+// ParseGeneralParameters reads params.json without validating the
+// values, e.g. for fixing a wrong value from the command line.
+func ParseGeneralParameters(configpath string) (map[string]string, error) {
+	var cfg JsonConfigList
+	filename := configpath + "/params.json"
+	filecontent, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
 	}
 	err = json.Unmarshal(filecontent, &cfg)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
 
 	// build the map that will be returned
@@ -98,40 +130,166 @@ func ReadGeneralParameters(configpath string) map[string]string {
 	for _, v := range cfg.Params {
 		configMap[v.Name] = v.Value
 	}
+	return configMap, nil
+}
 
+// ValidateGeneralParameters checks the values of the general
+// configuration and returns an error describing the first wrong one.
+func ValidateGeneralParameters(configMap map[string]string) error {
 	// check value: root directory
 	rootDirectory, ok := configMap["root_directory"]
 	if !ok {
-		log.Fatal("root_directory not defined in " + filename)
+		return errors.New("root_directory not defined")
 	}
-	if _, err := os.Stat(rootDirectory); err == nil {
-		// fmt.Println("Root directory found:\n\t" + rootDirectory)
-	} else if errors.Is(err, os.ErrNotExist) {
-		// TODO - this is too violent; fix it in future
-		log.Println("root directory not found")
-		log.Fatal(err)
-	} else {
-		log.Println("error checking root directory")
-		log.Fatal(err)
+	if finfo, err := os.Stat(rootDirectory); errors.Is(err, os.ErrNotExist) {
+		return errors.New("root directory \"" + rootDirectory + "\" not found")
+	} else if err != nil {
+		return fmt.Errorf("error checking root directory \"%s\": %w", rootDirectory, err)
+	} else if !finfo.IsDir() {
+		return errors.New("root directory \"" + rootDirectory + "\" is not a directory")
 	}
 
 	// check value: http port
-	_, ok = configMap["http_port"]
+	httpPort, ok := configMap["http_port"]
 	if !ok {
-		log.Fatal("http_port not defined in " + filename)
+		return errors.New("http_port not defined")
+	}
+	if _, err := ParsePort(httpPort); err != nil {
+		return errors.New("http_port: " + err.Error())
 	}
 
 	// check value: admin_path (web management console)
 	_, ok = configMap["admin_path"]
 	if !ok {
-		log.Fatal("admin_path not defined in " + filename)
+		return errors.New("admin_path not defined")
 	}
 
 	// check value: list of admin users
 	_, ok = configMap["admin_users"]
 	if !ok {
-		log.Fatal("admin_users not defined in " + filename)
+		return errors.New("admin_users not defined")
 	}
 
-	return configMap
+	// check values: TLS certificate and key (optional, both
+	// of them must be defined to enable HTTPS)
+	certFile := configMap["tls_cert_file"]
+	keyFile := configMap["tls_key_file"]
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("tls_cert_file and tls_key_file must be both defined or both empty")
+	}
+	if certFile != "" {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return fmt.Errorf("cannot load the TLS certificate \"%s\" and key \"%s\": %w", certFile, keyFile, err)
+		}
+	}
+
+	// check value: plain HTTP port redirecting to HTTPS (optional)
+	if redirectPort := configMap["http_redirect_port"]; redirectPort != "" {
+		if certFile == "" {
+			return errors.New("http_redirect_port is defined, but HTTPS is not configured")
+		}
+		if _, err := ParsePort(redirectPort); err != nil {
+			return errors.New("http_redirect_port: " + err.Error())
+		}
+		if redirectPort == configMap["http_port"] {
+			return errors.New("http_redirect_port and http_port cannot be the same")
+		}
+	}
+
+	// check value: maximum upload size in MiB (optional)
+	if maxUpload := configMap["max_upload_mb"]; maxUpload != "" {
+		if n, err := strconv.Atoi(maxUpload); err != nil || n < 1 {
+			return errors.New("max_upload_mb must be a positive number")
+		}
+	}
+
+	// check value: session store (optional, "memory" by default)
+	if store := configMap["session_store"]; store != "" && store != "memory" && store != "file" {
+		return errors.New("session_store must be \"memory\" or \"file\"")
+	}
+
+	// check value: SameSite attribute of the session cookie (optional, "lax" by default)
+	if sameSite := configMap["cookie_samesite"]; sameSite != "" && sameSite != "lax" && sameSite != "strict" && sameSite != "none" {
+		return errors.New("cookie_samesite must be \"lax\", \"strict\" or \"none\"")
+	}
+	if configMap["cookie_samesite"] == "none" && certFile == "" {
+		return errors.New("cookie_samesite \"none\" requires HTTPS")
+	}
+
+	// check value: session idle timeout in minutes (optional)
+	if idleMinutes := configMap["session_idle_minutes"]; idleMinutes != "" {
+		if n, err := strconv.Atoi(idleMinutes); err != nil || n < 1 {
+			return errors.New("session_idle_minutes must be a positive number")
+		}
+	}
+
+	// check value: README.md under the directory listings (optional, "no" by default)
+	if showReadme := configMap["show_readme"]; showReadme != "" && showReadme != "yes" && showReadme != "no" {
+		return errors.New("show_readme must be \"yes\" or \"no\"")
+	}
+
+	// check value: thumbnail cache directory (optional, created when needed)
+	if thumbnailDirectory := configMap["thumbnail_directory"]; thumbnailDirectory != "" {
+		if finfo, err := os.Stat(thumbnailDirectory); err == nil && !finfo.IsDir() {
+			return errors.New("thumbnail directory \"" + thumbnailDirectory + "\" is not a directory")
+		}
+	}
+
+	// check values: server timeouts in seconds (optional, 0 means no limit)
+	for _, timeout := range []string{"read_timeout_seconds", "write_timeout_seconds", "idle_timeout_seconds", "shutdown_timeout_seconds"} {
+		if value := configMap[timeout]; value != "" {
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				return errors.New(timeout + " must be 0 or a positive number")
+			}
+		}
+	}
+
+	// check value: interval for reloading the changed configuration files (optional, 0 disables it)
+	if watchSeconds := configMap["config_watch_seconds"]; watchSeconds != "" {
+		if n, err := strconv.Atoi(watchSeconds); err != nil || n < 0 {
+			return errors.New("config_watch_seconds must be 0 or a positive number")
+		}
+	}
+
+	// check values: archive download limits (optional)
+	for _, limit := range []string{"archive_max_mb", "archive_max_files"} {
+		if value := configMap[limit]; value != "" {
+			if n, err := strconv.Atoi(value); err != nil || n < 1 {
+				return errors.New(limit + " must be a positive number")
+			}
+		}
+	}
+
+	// check values: extensions shown in the browser or downloaded (optional)
+	for _, list := range []string{"inline_extensions", "download_extensions"} {
+		if value := configMap[list]; value != "" {
+			for _, ext := range strings.Split(value, ",") {
+				ext = strings.TrimPrefix(strings.TrimSpace(ext), ".")
+				if ext == "" || strings.IndexFunc(ext, notExtensionCharacter) >= 0 {
+					return errors.New(list + " must be a comma separated list of extensions, e.g. \"pdf,jpg,png\"")
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParsePort validates a port number of the configuration; the same
+// check is used by the wizard, the commands and the admin console.
+func ParsePort(stringport string) (int, error) {
+	port, err := strconv.Atoi(stringport)
+	if err != nil {
+		return 0, errors.New("the port must be a number")
+	}
+	if port < 20 || port > 65535 {
+		return 0, errors.New("the port must be a number between 20 and 65535")
+	}
+	return port, nil
+}
+
+// notExtensionCharacter returns true for the characters that cannot
+// be part of a file extension in the configuration.
+func notExtensionCharacter(c rune) bool {
+	return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-')
 }
@@ -21,7 +21,8 @@ package mdao
 
 import (
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 )
@@ -30,10 +31,13 @@ import (
 // PERMISSIONS //
 /////////////////
 
-// JsonPermission is an json item of a configured permission
+// JsonPermission is an json item of a configured permission; Userlist
+// contains the users allowed to read a private directory, Writelist
+// the users allowed to write into it (upload and so on).
 type JsonPermission struct {
 	Directory string `json:"directory"`
 	Userlist  string `json:"userlist"`
+	Writelist string `json:"writelist,omitempty"`
 }
 
 // JsonPermList is a json collection of JsonPermission items
@@ -41,42 +45,70 @@ type JsonPermList struct {
 	Permissions []JsonPermission `json:"permissions"`
 }
 
-func ReadPermissions(configpath string) map[string]string {
-	// load the configuration
-	var cfg JsonPermList
-	filename := configpath + "/permissions.json"
-	configfile, err := os.Open(filename)
+// ReadPermissions returns two directory-userlist maps: the first one
+// for read access to private directories, the second one for write
+// access. A directory can be public and have write grants anyway.
+func ReadPermissions(configpath string) (map[string]string, map[string]string) {
+	readMap, writeMap, err := LoadPermissions(configpath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Println("The configuration directory exists, but it does not contain \"" + configpath + "/permissions.json\"; if you want to reset the configuration, remove the entire directory, not just its files.")
+	}
 	if err != nil {
-		log.Println("The configuration directory exists, but it does not contain \"" + filename + "\"; if you want to reset the configuration, remove the entire directory, not just its files.")
 		log.Fatal(err)
 	}
-	defer configfile.Close()
-	filecontent, err := io.ReadAll(configfile)
+	return readMap, writeMap
+}
+
+// LoadPermissions reads permissions.json returning the errors instead
+// of exiting.
+func LoadPermissions(configpath string) (map[string]string, map[string]string, error) {
+	var cfg JsonPermList
+	filename := configpath + "/permissions.json"
+	filecontent, err := os.ReadFile(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 	err = json.Unmarshal(filecontent, &cfg)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, fmt.Errorf("%s: %w", filename, err)
 	}
 
-	// build the map that will be returned
-	var configMap = map[string]string{}
+	// build the maps that will be returned
+	var readMap = map[string]string{}
+	var writeMap = map[string]string{}
 	for _, v := range cfg.Permissions {
-		configMap[v.Directory] = v.Userlist
+		if v.Directory == "" {
+			return nil, nil, errors.New("permission without directory in " + filename)
+		}
+		if v.Userlist != "" {
+			readMap[v.Directory] = v.Userlist
+		}
+		if v.Writelist != "" {
+			writeMap[v.Directory] = v.Writelist
+		}
 	}
-	return configMap
+	return readMap, writeMap, nil
 }
 
-func WritePermissionsJson(path string, permissions map[string]string) {
+func WritePermissionsJson(path string, permissions map[string]string, writePermissions map[string]string) {
 	var jperms JsonPermList
 	var jpermSlice []JsonPermission
 	for k, v := range permissions {
 		var jp JsonPermission
 		jp.Directory = k
 		jp.Userlist = v
+		jp.Writelist = writePermissions[k]
 		jpermSlice = append(jpermSlice, jp)
 	}
+	for k, v := range writePermissions {
+		if _, found := permissions[k]; !found {
+			// public directory with write grants
+			var jp JsonPermission
+			jp.Directory = k
+			jp.Writelist = v
+			jpermSlice = append(jpermSlice, jp)
+		}
+	}
 	jperms.Permissions = jpermSlice
 
 	json, err := json.MarshalIndent(jperms, "", "\t")
@@ -0,0 +1,110 @@
+package mdao
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+////////////////
+// API TOKENS //
+////////////////
+
+// JsonToken is an json item of an API token; only the hash of the
+// token is stored, the token itself is shown once when created.
+type JsonToken struct {
+	Id          string `json:"id"`
+	Username    string `json:"username"`
+	Hash        string `json:"hash"`
+	Description string `json:"description"`
+	Created     string `json:"created"`
+}
+
+// JsonTokenList is a json collection of JsonToken items
+type JsonTokenList struct {
+	Tokens []JsonToken `json:"tokens"`
+}
+
+func WriteTokensJson(path string, tokens map[string]JsonToken) {
+	var jtokens JsonTokenList
+	jtok := []JsonToken{}
+	for _, v := range tokens {
+		jtok = append(jtok, v)
+	}
+	jtokens.Tokens = jtok
+
+	json, err := json.MarshalIndent(jtokens, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	filename := path + "/tokens.json"
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	n, err := f.Write(json)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n == 0 {
+		log.Fatal("error: could not write anything to", filename)
+	}
+}
+
+// ReadTokens returns an id-token map; tokens.json is optional, because
+// it is created only when the first token is saved.
+func ReadTokens(configpath string) map[string]JsonToken {
+	tokenMap, err := LoadTokens(configpath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tokenMap
+}
+
+// LoadTokens reads tokens.json returning the errors instead of exiting.
+func LoadTokens(configpath string) (map[string]JsonToken, error) {
+	var cfg JsonTokenList
+	var tokenMap = map[string]JsonToken{}
+	filename := configpath + "/tokens.json"
+	filecontent, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return tokenMap, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(filecontent, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	// build the map that will be returned
+	for _, v := range cfg.Tokens {
+		tokenMap[v.Id] = v
+	}
+	return tokenMap, nil
+}
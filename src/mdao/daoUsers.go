@@ -21,7 +21,8 @@ package mdao
 
 import (
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 )
@@ -74,28 +75,36 @@ func WriteUsersJson(path string, users map[string]string) {
 }
 
 func ReadUsers(configpath string) map[string]string {
-	// load the configuration
-	var cfg JsonUserList
-	filename := configpath + "/users.json"
-	configfile, err := os.Open(filename)
+	users, err := LoadUsers(configpath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Println("The configuration directory exists, but it does not contain \"" + configpath + "/users.json\"; if you want to reset the configuration, remove the entire directory, not just its files.")
+	}
 	if err != nil {
-		log.Println("The configuration directory exists, but it does not contain \"" + filename + "\"; if you want to reset the configuration, remove the entire directory, not just its files.")
 		log.Fatal(err)
 	}
-	defer configfile.Close()
-	filecontent, err := io.ReadAll(configfile)
+	return users
+}
+
+// LoadUsers reads users.json returning the errors instead of exiting.
+func LoadUsers(configpath string) (map[string]string, error) {
+	var cfg JsonUserList
+	filename := configpath + "/users.json"
+	filecontent, err := os.ReadFile(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	err = json.Unmarshal(filecontent, &cfg)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
 
 	// build the map that will be returned
 	var configMap = map[string]string{}
 	for _, v := range cfg.Users {
+		if v.Username == "" {
+			return nil, errors.New("user without username in " + filename)
+		}
 		configMap[v.Username] = v.Password
 	}
-	return configMap
+	return configMap, nil
 }
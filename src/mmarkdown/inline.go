@@ -0,0 +1,576 @@
+package mmarkdown
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"html"
+	"sort"
+	"strings"
+)
+
+// inline renders the text of a paragraph, a heading or a table cell:
+// emphasis, code spans, links, images and line breaks.
+func (r *renderer) inline(s string) string {
+	// the text of links and emphasis is rendered recursively
+	if r.inlineNesting >= maxNesting {
+		return html.EscapeString(s)
+	}
+	r.inlineNesting++
+	defer func() { r.inlineNesting-- }()
+	x := newInlineIndex(s)
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br/>\n")
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(punctuation, s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+		case c == ' ':
+			// two spaces at the end of a line are a line break
+			j := i
+			for j < len(s) && s[j] == ' ' {
+				j++
+			}
+			if j < len(s) && s[j] == '\n' {
+				if j-i >= 2 {
+					b.WriteString("<br/>")
+				}
+				i = j
+				continue
+			}
+		case c == '`':
+			if code, end, ok := codeSpan(s, i, x); ok {
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i = end
+				continue
+			}
+			// an unmatched run of backticks is plain text
+			j := i
+			for j < len(s) && s[j] == '`' {
+				j++
+			}
+			b.WriteString(s[i:j])
+			i = j
+			continue
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if rendered, end, ok := r.link(s, i+1, true, x); ok {
+				b.WriteString(rendered)
+				i = end
+				continue
+			}
+		case c == '[':
+			if rendered, end, ok := r.link(s, i, false, x); ok {
+				b.WriteString(rendered)
+				i = end
+				continue
+			}
+		case c == '<':
+			if rendered, end, ok := autolink(s, i); ok {
+				b.WriteString(rendered)
+				i = end
+				continue
+			}
+		case c == '*' || c == '_' || c == '~':
+			if rendered, end, ok := r.emphasis(s, i, x); ok {
+				b.WriteString(rendered)
+				i = end
+				continue
+			}
+			// the rest of the run cannot open emphasis either
+			j := i
+			for j < len(s) && s[j] == c {
+				j++
+			}
+			b.WriteString(s[i:j])
+			i = j
+			continue
+		case c == '&':
+			if m := entity.FindString(s[i:]); m != "" {
+				b.WriteString(m)
+				i += len(m)
+				continue
+			}
+		case c == 'h' && (i == 0 || strings.IndexByte(" \n\t(*_~", s[i-1]) >= 0):
+			if rendered, end, ok := bareUrl(s, i); ok {
+				b.WriteString(rendered)
+				i = end
+				continue
+			}
+		}
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// inlineIndex locates the delimiters of a text in a single pass, so
+// that finding the end of a code span, an emphasis or a link is a
+// lookup: a scan from every opening delimiter would take a time
+// quadratic in the length of the text (e.g. thousands of "[").
+type inlineIndex struct {
+	s string
+	// backticks contains the positions of the runs of backticks,
+	// indexed by their length
+	backticks map[int][]int
+	// brackets contains the position of the ']' matching each '['
+	brackets map[int]int
+	// closers contains the positions of the runs that can close an
+	// emphasis, indexed by character and length
+	closers map[delimiterRun][]int
+	// parenDepth contains the depth of the parentheses after each
+	// '(', closingParens the positions of the ')' indexed by the
+	// depth before them
+	parenDepth    map[int]int
+	closingParens map[int][]int
+	// characters contains the positions of the characters of a set,
+	// see nextOf
+	characters map[string][]int
+}
+
+// delimiterRun is a run of n characters c, e.g. "**"
+type delimiterRun struct {
+	c byte
+	n int
+}
+
+// newInlineIndex returns the index of the delimiters of s.
+func newInlineIndex(s string) *inlineIndex {
+	x := &inlineIndex{
+		s:             s,
+		backticks:     map[int][]int{},
+		brackets:      map[int]int{},
+		closers:       map[delimiterRun][]int{},
+		parenDepth:    map[int]int{},
+		closingParens: map[int][]int{},
+		characters:    map[string][]int{},
+	}
+	for j := 0; j < len(s); {
+		n := runLength(s, j)
+		if s[j] == '`' {
+			x.backticks[n] = append(x.backticks[n], j)
+		}
+		j += n
+	}
+	// brackets and emphasis, outside code spans and escapes
+	var openBrackets []int
+	for j := 0; j < len(s); {
+		if next := skipInline(s, j, x); next != j {
+			j = next
+			continue
+		}
+		switch c := s[j]; c {
+		case '`':
+			// an unmatched run of backticks is plain text
+			j += runLength(s, j)
+			continue
+		case '[':
+			openBrackets = append(openBrackets, j)
+		case ']':
+			if len(openBrackets) > 0 {
+				x.brackets[openBrackets[len(openBrackets)-1]] = j
+				openBrackets = openBrackets[:len(openBrackets)-1]
+			}
+		case '*', '_', '~':
+			n := runLength(s, j)
+			// the closing delimiter must follow text, and underscores
+			// inside words are not emphasis
+			if j > 0 && !isSpace(s[j-1]) && !(c == '_' && j+n < len(s) && isAlphanumeric(s[j+n])) {
+				run := delimiterRun{c: c, n: n}
+				x.closers[run] = append(x.closers[run], j)
+			}
+			j += n
+			continue
+		}
+		j++
+	}
+	// parentheses of the link destinations, outside escapes only
+	depth := 0
+	for j := 0; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '(':
+			depth++
+			x.parenDepth[j] = depth
+		case ')':
+			x.closingParens[depth] = append(x.closingParens[depth], j)
+			depth--
+		}
+	}
+	return x
+}
+
+// runLength returns the number of equal characters starting at s[i].
+func runLength(s string, i int) int {
+	n := 1
+	for i+n < len(s) && s[i+n] == s[i] {
+		n++
+	}
+	return n
+}
+
+// firstFrom returns the first of the sorted positions not before
+// from, or -1.
+func firstFrom(positions []int, from int) int {
+	k := sort.SearchInts(positions, from)
+	if k == len(positions) {
+		return -1
+	}
+	return positions[k]
+}
+
+// nextOf returns the position of the first character of set in the
+// text, not before from, or -1.
+func (x *inlineIndex) nextOf(set string, from int) int {
+	positions, found := x.characters[set]
+	if !found {
+		for j := 0; j < len(x.s); j++ {
+			if strings.IndexByte(set, x.s[j]) >= 0 {
+				positions = append(positions, j)
+			}
+		}
+		x.characters[set] = positions
+	}
+	return firstFrom(positions, from)
+}
+
+// punctuation contains the characters that can be escaped with a backslash
+const punctuation string = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// codeSpan returns the content of the code span starting at s[i], and
+// the position after it.
+func codeSpan(s string, i int, x *inlineIndex) (string, int, bool) {
+	n := runLength(s, i)
+	j := firstFrom(x.backticks[n], i+n)
+	if j < 0 {
+		return "", 0, false
+	}
+	code := strings.ReplaceAll(s[i+n:j], "\n", " ")
+	if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+		code = code[1 : len(code)-1]
+	}
+	return code, j + n, true
+}
+
+// skipInline returns the position after the code span or the escaped
+// character starting at s[i], or i when there is none.
+func skipInline(s string, i int, x *inlineIndex) int {
+	if s[i] == '\\' && i+1 < len(s) {
+		return i + 2
+	}
+	if s[i] == '`' {
+		if _, end, ok := codeSpan(s, i, x); ok {
+			return end
+		}
+	}
+	return i
+}
+
+// isSpace returns true for the white space characters.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\t'
+}
+
+// isAlphanumeric returns true for letters and digits, including the
+// bytes of the non ASCII characters.
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// emphasis renders *em*, **strong**, ***both*** (or with underscores)
+// and ~~strikethrough~~ starting at s[i].
+func (r *renderer) emphasis(s string, i int, x *inlineIndex) (string, int, bool) {
+	c := s[i]
+	run := 0
+	for i+run < len(s) && s[i+run] == c {
+		run++
+	}
+	// the opening delimiter must be followed by text, and underscores
+	// inside words are not emphasis
+	if i+run >= len(s) || isSpace(s[i+run]) || (c == '_' && i > 0 && isAlphanumeric(s[i-1])) {
+		return "", 0, false
+	}
+	var lengths []int
+	switch {
+	case c == '~' && run == 2:
+		lengths = []int{2}
+	case c == '~':
+		return "", 0, false
+	case run >= 3:
+		lengths = []int{3, 2, 1}
+	case run == 2:
+		lengths = []int{2, 1}
+	default:
+		lengths = []int{1}
+	}
+	for _, n := range lengths {
+		// when the closing run is shorter, the first characters of the
+		// opening one are plain text
+		end := firstFrom(x.closers[delimiterRun{c: c, n: n}], i+run)
+		if end < 0 {
+			continue
+		}
+		inner := r.inline(s[i+run : end])
+		switch {
+		case c == '~':
+			inner = "<del>" + inner + "</del>"
+		case n == 3:
+			inner = "<em><strong>" + inner + "</strong></em>"
+		case n == 2:
+			inner = "<strong>" + inner + "</strong>"
+		default:
+			inner = "<em>" + inner + "</em>"
+		}
+		return strings.Repeat(string(c), run-n) + inner, end + n, true
+	}
+	return "", 0, false
+}
+
+// maxLabelLength is the longest label of a reference, as in CommonMark.
+const maxLabelLength int = 999
+
+// link renders a link, or an image when image is true, whose text
+// starts with the bracket at s[i]: inline links [text](url "title"),
+// full references [text][label] and shortcut references [label].
+func (r *renderer) link(s string, i int, image bool, x *inlineIndex) (string, int, bool) {
+	// the closing bracket, skipping nested brackets and code spans
+	closing, found := x.brackets[i]
+	if !found {
+		return "", 0, false
+	}
+	text := s[i+1 : closing]
+	end := closing + 1
+	var destination, title string
+
+	if end < len(s) && s[end] == '(' {
+		var ok bool
+		destination, title, end, ok = inlineDestination(s, end, x)
+		if !ok {
+			return "", 0, false
+		}
+	} else {
+		label := text
+		if end+1 < len(s) && s[end] == '[' {
+			if k := x.nextOf("]", end) - end; k > 0 {
+				if k > 1 {
+					label = s[end+1 : end+k]
+				}
+				end += k + 1
+			}
+		}
+		// labels are short, and normalizing a long text for every
+		// nested bracket would take a quadratic time
+		if len(label) > maxLabelLength {
+			return "", 0, false
+		}
+		ref, found := r.references[normalizeLabel(label)]
+		if !found {
+			return "", 0, false
+		}
+		destination, title = ref.destination, ref.title
+	}
+
+	url, allowed := r.destination(destination, image)
+	titleAttribute := ""
+	if title != "" {
+		titleAttribute = " title=\"" + html.EscapeString(title) + "\""
+	}
+	if image {
+		alt := html.EscapeString(plainText(text))
+		if !allowed {
+			return alt, end, true
+		}
+		return "<img src=\"" + html.EscapeString(url) + "\" alt=\"" + alt + "\"" + titleAttribute + "/>", end, true
+	}
+	inner := r.inline(text)
+	if !allowed {
+		return inner, end, true
+	}
+	return "<a href=\"" + html.EscapeString(url) + "\"" + titleAttribute + externalRel(url) + ">" + inner + "</a>", end, true
+}
+
+// inlineDestination parses (url "title") starting at the parenthesis
+// s[i] and returns the position after it.
+func inlineDestination(s string, i int, x *inlineIndex) (string, string, int, bool) {
+	j := i + 1
+	for j < len(s) && isSpace(s[j]) {
+		j++
+	}
+	var destination string
+	if j < len(s) && s[j] == '<' {
+		k := x.nextOf(">\n", j)
+		if k < 0 || s[k] != '>' {
+			return "", "", 0, false
+		}
+		destination = s[j+1 : k]
+		j = k + 1
+	} else {
+		// the destination ends at the first space, or at the ')'
+		// closing the parenthesis s[i]
+		start := j
+		j = x.nextOf(" \n\t", start)
+		if j < 0 {
+			j = len(s)
+		}
+		if depth, found := x.parenDepth[i]; found {
+			if k := firstFrom(x.closingParens[depth], start); k >= 0 && k < j {
+				j = k
+			}
+		}
+		destination = s[start:j]
+	}
+	for j < len(s) && isSpace(s[j]) {
+		j++
+	}
+	title := ""
+	if j < len(s) && strings.IndexByte("\"'(", s[j]) >= 0 {
+		closing := s[j]
+		if closing == '(' {
+			closing = ')'
+		}
+		k := x.nextOf(string(closing), j+1)
+		if k < 0 {
+			return "", "", 0, false
+		}
+		title = s[j+1 : k]
+		j = k + 1
+		for j < len(s) && isSpace(s[j]) {
+			j++
+		}
+	}
+	if j >= len(s) || s[j] != ')' {
+		return "", "", 0, false
+	}
+	return unescapeBackslashes(destination), title, j + 1, true
+}
+
+// unescapeBackslashes removes the backslashes escaping punctuation.
+func unescapeBackslashes(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(punctuation, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// plainText removes the most common markup from the text of an image,
+// that becomes the alternative text.
+func plainText(s string) string {
+	return strings.NewReplacer("*", "", "_", "", "`", "", "[", "", "]", "", "\\", "").Replace(s)
+}
+
+// destination checks the destination of a link: absolute URLs must
+// be http, https or mailto (not for images), the relative ones are
+// passed to the resolver.
+func (r *renderer) destination(destination string, image bool) (string, bool) {
+	if destination == "" || strings.HasPrefix(destination, "#") {
+		return destination, !image
+	}
+	if strings.HasPrefix(destination, "//") {
+		return "", false
+	}
+	if k := strings.IndexAny(destination, ":/?#"); k > 0 && destination[k] == ':' {
+		switch strings.ToLower(destination[:k]) {
+		case "http", "https":
+			return destination, true
+		case "mailto":
+			return destination, !image
+		}
+		return "", false
+	}
+	if r.resolve == nil {
+		return destination, true
+	}
+	return r.resolve(destination, image)
+}
+
+// externalRel returns the rel attribute of the links to other sites.
+func externalRel(url string) string {
+	lower := strings.ToLower(url)
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+		return " rel=\"noopener noreferrer\""
+	}
+	return ""
+}
+
+// autolink renders <http://...> and <user@example.com>.
+func autolink(s string, i int) (string, int, bool) {
+	k := strings.IndexAny(s[i+1:], "> \n<")
+	if k < 1 || s[i+1+k] != '>' {
+		return "", 0, false
+	}
+	target := s[i+1 : i+1+k]
+	lower := strings.ToLower(target)
+	href := target
+	switch {
+	case strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "mailto:"):
+	case strings.Count(target, "@") == 1 && !strings.Contains(target, ":") && strings.Index(target, "@") > 0:
+		href = "mailto:" + target
+	default:
+		return "", 0, false
+	}
+	return "<a href=\"" + html.EscapeString(href) + "\"" + externalRel(href) + ">" + html.EscapeString(target) + "</a>", i + 2 + k, true
+}
+
+// bareUrl renders the http and https URLs written without markup.
+func bareUrl(s string, i int) (string, int, bool) {
+	prefix := s[i:]
+	if len(prefix) > len("https://") {
+		prefix = prefix[:len("https://")]
+	}
+	lower := strings.ToLower(prefix)
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		return "", 0, false
+	}
+	end := i
+	for end < len(s) && !isSpace(s[end]) && s[end] != '<' {
+		end++
+	}
+	// the final punctuation is not part of the URL, like the closing
+	// parenthesis without an opening one
+	opening, closing := strings.Count(s[i:end], "("), strings.Count(s[i:end], ")")
+	for end > i {
+		last := s[end-1]
+		if strings.IndexByte(".,:;!?\"'*_~", last) >= 0 || (last == ')' && opening < closing) {
+			if last == ')' {
+				closing--
+			}
+			end--
+			continue
+		}
+		break
+	}
+	url := s[i:end]
+	if strings.Index(url, "://")+3 >= len(url) {
+		return "", 0, false
+	}
+	return "<a href=\"" + html.EscapeString(url) + "\"" + externalRel(url) + ">" + html.EscapeString(url) + "</a>", end, true
+}
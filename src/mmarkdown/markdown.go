@@ -0,0 +1,571 @@
+package mmarkdown
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LinkResolver rewrites the destination of a relative link or image.
+// When the second value is false the reader cannot follow it: the link
+// is rendered as plain text and the image as its alternative text.
+type LinkResolver func(destination string, image bool) (string, bool)
+
+// reference is a link reference definition, e.g. [name]: url "title"
+type reference struct {
+	destination string
+	title       string
+}
+
+type renderer struct {
+	resolve    LinkResolver
+	references map[string]reference
+	headingIds map[string]int
+	// blockNesting and inlineNesting count the blockquotes and lists,
+	// and the links and emphasis, containing the current one
+	blockNesting  int
+	inlineNesting int
+}
+
+// maxNesting limits the nested blocks and inline elements: deeper ones
+// are rendered as text, so that a long line like "> > > > ..." is not
+// parsed once for every level
+const maxNesting int = 16
+
+var referenceDefinition = regexp.MustCompile(`^ {0,3}\[([^\]]+)\]:\s*<?([^\s>]+)>?(?:\s+(?:"([^"]*)"|'([^']*)'|\(([^)]*)\)))?\s*$`)
+var atxHeading = regexp.MustCompile(`^ {0,3}(#{1,6})(?:\s+(.*?))?(?:\s+#+)?\s*$`)
+var listMarker = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])( +|$)`)
+var tableDelimiter = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+var entity = regexp.MustCompile(`^&(?:[a-zA-Z][a-zA-Z0-9]{1,31}|#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6});`)
+
+// ToHtml renders a Markdown document (CommonMark, with tables, task
+// lists, strikethrough and bare URLs of GitHub) as HTML. The output is
+// safe: the HTML of the source is escaped, and only the http, https
+// and mailto absolute links are kept; the relative ones are passed to
+// resolve, when it is not nil.
+func ToHtml(source string, resolve LinkResolver) string {
+	r := renderer{resolve: resolve, references: map[string]reference{}, headingIds: map[string]int{}}
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	source = strings.ReplaceAll(source, "\r", "\n")
+	source = strings.ReplaceAll(source, "\x00", "�")
+	lines := strings.Split(source, "\n")
+	for i := range lines {
+		lines[i] = expandTabs(lines[i])
+	}
+	lines = r.collectReferences(lines)
+	var b strings.Builder
+	r.blocks(&b, lines, false)
+	return b.String()
+}
+
+// expandTabs replaces the tabs with spaces, with tab stops of 4.
+func expandTabs(line string) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+	var b strings.Builder
+	column := 0
+	for _, c := range line {
+		if c == '\t' {
+			n := 4 - column%4
+			b.WriteString(strings.Repeat(" ", n))
+			column += n
+		} else {
+			b.WriteRune(c)
+			column++
+		}
+	}
+	return b.String()
+}
+
+// collectReferences removes the link reference definitions (outside
+// the code blocks) and keeps them for the links.
+func (r *renderer) collectReferences(lines []string) []string {
+	var retval []string
+	fence := ""
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+				fence = ""
+			}
+			retval = append(retval, line)
+			continue
+		}
+		if f := fenceOpening(line); f != "" {
+			fence = f
+			retval = append(retval, line)
+			continue
+		}
+		if m := referenceDefinition.FindStringSubmatch(line); m != nil && len(m[1]) <= maxLabelLength {
+			label := normalizeLabel(m[1])
+			if _, found := r.references[label]; !found {
+				r.references[label] = reference{destination: m[2], title: m[3] + m[4] + m[5]}
+			}
+			continue
+		}
+		retval = append(retval, line)
+	}
+	return retval
+}
+
+// normalizeLabel makes reference labels case and space insensitive.
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+// indentation returns the number of leading spaces of a line.
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// fenceOpening returns the fence (e.g. "```") when the line opens a
+// fenced code block, or an empty string.
+func fenceOpening(line string) string {
+	if indentation(line) > 3 {
+		return ""
+	}
+	trimmed := strings.TrimSpace(line)
+	for _, c := range []string{"`", "~"} {
+		n := len(trimmed) - len(strings.TrimLeft(trimmed, c))
+		if n >= 3 {
+			if c == "`" && strings.Contains(trimmed[n:], "`") {
+				return ""
+			}
+			return strings.Repeat(c, n)
+		}
+	}
+	return ""
+}
+
+// isRule returns true for the thematic breaks, e.g. "---" or "* * *".
+func isRule(line string) bool {
+	if indentation(line) > 3 {
+		return false
+	}
+	trimmed := strings.ReplaceAll(strings.TrimSpace(line), " ", "")
+	if len(trimmed) < 3 {
+		return false
+	}
+	return strings.Trim(trimmed, trimmed[:1]) == "" && strings.ContainsAny(trimmed[:1], "-*_")
+}
+
+// setextLevel returns 1 or 2 when the line underlines a heading
+// ("===" or "---"), 0 otherwise.
+func setextLevel(line string) int {
+	if indentation(line) > 3 {
+		return 0
+	}
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case trimmed == "":
+		return 0
+	case strings.Trim(trimmed, "=") == "":
+		return 1
+	case strings.Trim(trimmed, "-") == "":
+		return 2
+	}
+	return 0
+}
+
+// interruptsParagraph returns true when a line starts a block that
+// ends the paragraph before it.
+func interruptsParagraph(line string) bool {
+	if indentation(line) > 3 {
+		return false
+	}
+	trimmed := strings.TrimSpace(line)
+	if fenceOpening(line) != "" || atxHeading.MatchString(line) || isRule(line) || strings.HasPrefix(trimmed, ">") {
+		return true
+	}
+	// empty items and ordered lists not starting from 1 do not
+	// interrupt a paragraph
+	if m := listMarker.FindStringSubmatch(line); m != nil && strings.TrimSpace(line[len(m[0]):]) != "" {
+		return !strings.ContainsAny(m[2][len(m[2])-1:], ".)") || m[2][:len(m[2])-1] == "1"
+	}
+	return false
+}
+
+// blocks renders a sequence of lines. In tight lists the paragraphs
+// are written without <p>.
+func (r *renderer) blocks(b *strings.Builder, lines []string, tight bool) {
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) == 0 {
+			return
+		}
+		text := strings.TrimRight(strings.Join(paragraph, "\n"), " ")
+		if tight {
+			b.WriteString(r.inline(text) + "\n")
+		} else {
+			b.WriteString("<p>" + r.inline(text) + "</p>\n")
+		}
+		paragraph = nil
+	}
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		indent := indentation(line)
+		switch {
+		case trimmed == "":
+			flush()
+			i++
+		case len(paragraph) > 0 && setextLevel(line) > 0:
+			level := setextLevel(line)
+			text := strings.TrimSpace(strings.Join(paragraph, "\n"))
+			paragraph = nil
+			r.heading(b, level, text)
+			i++
+		case len(paragraph) > 0 && !interruptsParagraph(line):
+			// lazy continuation of the paragraph
+			paragraph = append(paragraph, strings.TrimLeft(line, " "))
+			i++
+		case indent >= 4:
+			i = r.indentedCode(b, lines, i)
+		case fenceOpening(line) != "":
+			flush()
+			i = r.fencedCode(b, lines, i)
+		case atxHeading.MatchString(line):
+			flush()
+			m := atxHeading.FindStringSubmatch(line)
+			r.heading(b, len(m[1]), m[2])
+			i++
+		case isRule(line):
+			flush()
+			b.WriteString("<hr/>\n")
+			i++
+		case strings.HasPrefix(trimmed, ">") && r.blockNesting < maxNesting:
+			flush()
+			i = r.blockquote(b, lines, i)
+		case listMarker.MatchString(line) && r.blockNesting < maxNesting:
+			flush()
+			i = r.list(b, lines, i)
+		case i+1 < len(lines) && strings.Contains(line, "|") && tableDelimiter.MatchString(lines[i+1]) && len(splitRow(line)) == len(splitRow(lines[i+1])):
+			i = r.table(b, lines, i)
+		default:
+			paragraph = append(paragraph, strings.TrimLeft(line, " "))
+			i++
+		}
+	}
+	flush()
+}
+
+// heading writes a heading with an id, so that it can be linked.
+func (r *renderer) heading(b *strings.Builder, level int, text string) {
+	id := slug(text)
+	if n := r.headingIds[id]; n > 0 {
+		r.headingIds[id] = n + 1
+		id += "-" + strconv.Itoa(n)
+	} else {
+		r.headingIds[id] = 1
+	}
+	tag := "h" + strconv.Itoa(level)
+	b.WriteString("<" + tag + " id=\"" + html.EscapeString(id) + "\">" + r.inline(text) + "</" + tag + ">\n")
+}
+
+// slug returns the anchor of a heading, like GitHub does: lower case,
+// spaces replaced by hyphens, punctuation removed.
+func slug(text string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(strings.TrimSpace(text)) {
+		switch {
+		case c == ' ' || c == '-':
+			b.WriteRune('-')
+		case c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c > 127:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func (r *renderer) indentedCode(b *strings.Builder, lines []string, i int) int {
+	var code []string
+	for ; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "" {
+			code = append(code, "")
+		} else if indentation(lines[i]) >= 4 {
+			code = append(code, lines[i][4:])
+		} else {
+			break
+		}
+	}
+	for len(code) > 0 && code[len(code)-1] == "" {
+		code = code[:len(code)-1]
+	}
+	b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "\n</code></pre>\n")
+	return i
+}
+
+func (r *renderer) fencedCode(b *strings.Builder, lines []string, i int) int {
+	indent := indentation(lines[i])
+	fence := fenceOpening(lines[i])
+	info := strings.TrimSpace(strings.TrimSpace(lines[i])[len(fence):])
+	var code []string
+	for i++; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if indentation(lines[i]) <= 3 && strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			i++
+			break
+		}
+		line := lines[i]
+		if n := indentation(line); n > 0 {
+			if n > indent {
+				n = indent
+			}
+			line = line[n:]
+		}
+		code = append(code, line)
+	}
+	class := ""
+	if language := strings.Fields(info); len(language) > 0 {
+		class = " class=\"language-" + html.EscapeString(language[0]) + "\""
+	}
+	content := html.EscapeString(strings.Join(code, "\n"))
+	if len(code) > 0 {
+		content += "\n"
+	}
+	b.WriteString("<pre><code" + class + ">" + content + "</code></pre>\n")
+	return i
+}
+
+func (r *renderer) blockquote(b *strings.Builder, lines []string, i int) int {
+	var quoted []string
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimLeft(line, " ")
+		if indentation(line) <= 3 && strings.HasPrefix(trimmed, ">") {
+			trimmed = trimmed[1:]
+			if strings.HasPrefix(trimmed, " ") {
+				trimmed = trimmed[1:]
+			}
+			quoted = append(quoted, trimmed)
+		} else if strings.TrimSpace(line) != "" && len(quoted) > 0 && strings.TrimSpace(quoted[len(quoted)-1]) != "" && !interruptsParagraph(line) {
+			// lazy continuation
+			quoted = append(quoted, line)
+		} else {
+			break
+		}
+	}
+	b.WriteString("<blockquote>\n")
+	r.blockNesting++
+	r.blocks(b, quoted, false)
+	r.blockNesting--
+	b.WriteString("</blockquote>\n")
+	return i
+}
+
+// listItem is an item of a list, with its lines without indentation.
+type listItem struct {
+	lines []string
+}
+
+// markerKind returns the character identifying the list of a marker:
+// the bullet, or the delimiter of ordered lists.
+func markerKind(marker string) string {
+	return marker[len(marker)-1:]
+}
+
+func (r *renderer) list(b *strings.Builder, lines []string, i int) int {
+	first := listMarker.FindStringSubmatch(lines[i])
+	kind := markerKind(first[2])
+	ordered := strings.ContainsAny(kind, ".)")
+	start := 1
+	if ordered {
+		start, _ = strconv.Atoi(first[2][:len(first[2])-1])
+	}
+
+	var items []listItem
+	loose := false
+	for i < len(lines) {
+		m := listMarker.FindStringSubmatch(lines[i])
+		if m == nil || markerKind(m[2]) != kind || (len(items) > 0 && isRule(lines[i])) {
+			break
+		}
+		// the content starts after the marker and its spaces, but when
+		// there are more than 4 spaces, the content is indented code
+		contentIndent := len(m[0])
+		if len(m[3]) > 4 {
+			contentIndent = len(m[1]) + len(m[2]) + 1
+		}
+		item := listItem{}
+		if len(lines[i]) > contentIndent {
+			item.lines = append(item.lines, lines[i][contentIndent:])
+		} else {
+			item.lines = append(item.lines, "")
+		}
+		if strings.TrimSpace(lines[i]) == strings.TrimSpace(m[0]) {
+			// an empty first line: the content is on the next lines
+			contentIndent = len(m[1]) + len(m[2]) + 1
+		}
+		i++
+
+		ended := false
+		for i < len(lines) && !ended {
+			line := lines[i]
+			switch {
+			case strings.TrimSpace(line) == "":
+				// a blank line, the item continues if the next line is indented
+				j := i
+				for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+					j++
+				}
+				if j < len(lines) && indentation(lines[j]) >= contentIndent {
+					for ; i < j; i++ {
+						item.lines = append(item.lines, "")
+					}
+					loose = loose || hasContent(item.lines)
+				} else {
+					if j < len(lines) {
+						if next := listMarker.FindStringSubmatch(lines[j]); next != nil && markerKind(next[2]) == kind && !isRule(lines[j]) {
+							loose = true
+							i = j
+						}
+					}
+					ended = true
+				}
+			case indentation(line) >= contentIndent:
+				item.lines = append(item.lines, line[contentIndent:])
+				i++
+			case listMarker.MatchString(line) || interruptsParagraph(line):
+				ended = true
+			case strings.TrimSpace(item.lines[len(item.lines)-1]) != "":
+				// lazy continuation of a paragraph
+				item.lines = append(item.lines, strings.TrimLeft(line, " "))
+				i++
+			default:
+				ended = true
+			}
+		}
+		items = append(items, item)
+		if i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+			break
+		}
+	}
+
+	if ordered {
+		if start != 1 {
+			b.WriteString("<ol start=\"" + strconv.Itoa(start) + "\">\n")
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		b.WriteString("<li>")
+		// task lists: "- [ ] to do" and "- [x] done"
+		if first := item.lines[0]; len(first) >= 4 && (strings.HasPrefix(first, "[ ] ") || strings.HasPrefix(strings.ToLower(first), "[x] ")) {
+			if first[1] == ' ' {
+				b.WriteString("<input type=\"checkbox\" disabled/> ")
+			} else {
+				b.WriteString("<input type=\"checkbox\" checked disabled/> ")
+			}
+			item.lines[0] = first[4:]
+		}
+		r.blockNesting++
+		r.blocks(b, item.lines, !loose)
+		r.blockNesting--
+		b.WriteString("</li>\n")
+	}
+	if ordered {
+		b.WriteString("</ol>\n")
+	} else {
+		b.WriteString("</ul>\n")
+	}
+	return i
+}
+
+// hasContent returns true when some of the lines are not blank.
+func hasContent(lines []string) bool {
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRow returns the cells of a table row.
+func splitRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, "\\|") {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+func (r *renderer) table(b *strings.Builder, lines []string, i int) int {
+	header := splitRow(lines[i])
+	var alignments []string
+	for _, d := range splitRow(lines[i+1]) {
+		switch {
+		case strings.HasPrefix(d, ":") && strings.HasSuffix(d, ":"):
+			alignments = append(alignments, " style=\"text-align:center\"")
+		case strings.HasSuffix(d, ":"):
+			alignments = append(alignments, " style=\"text-align:right\"")
+		case strings.HasPrefix(d, ":"):
+			alignments = append(alignments, " style=\"text-align:left\"")
+		default:
+			alignments = append(alignments, "")
+		}
+	}
+	row := func(cells []string, tag string) {
+		b.WriteString("<tr>")
+		for c := range header {
+			text := ""
+			if c < len(cells) {
+				text = cells[c]
+			}
+			b.WriteString("<" + tag + alignments[c] + ">" + r.inline(text) + "</" + tag + ">")
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("<table>\n<thead>\n")
+	row(header, "th")
+	b.WriteString("</thead>\n<tbody>\n")
+	for i += 2; i < len(lines); i++ {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" || (!strings.Contains(line, "|") && interruptsParagraph(line)) {
+			break
+		}
+		row(splitRow(line), "td")
+	}
+	b.WriteString("</tbody>\n</table>\n")
+	return i
+}
@@ -0,0 +1,172 @@
+package mmarkdown
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCases maps the Markdown sources to the expected HTML.
+type testCases []struct {
+	source string
+	html   string
+}
+
+// check renders the sources and compares them with the expected HTML.
+func (cases testCases) check(t *testing.T, resolve LinkResolver) {
+	t.Helper()
+	for _, c := range cases {
+		if html := ToHtml(c.source, resolve); html != c.html {
+			t.Errorf("ToHtml(%q)\n got %q\nwant %q", c.source, html, c.html)
+		}
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	testCases{
+		{"# Title\n\nText", "<h1 id=\"title\">Title</h1>\n<p>Text</p>\n"},
+		{"Title\n===\nSubtitle\n---", "<h1 id=\"title\">Title</h1>\n<h2 id=\"subtitle\">Subtitle</h2>\n"},
+		{"## Same\n## Same", "<h2 id=\"same\">Same</h2>\n<h2 id=\"same-1\">Same</h2>\n"},
+		{"a\nb\n\nc", "<p>a\nb</p>\n<p>c</p>\n"},
+		{"a\n\n***\n\nb", "<p>a</p>\n<hr/>\n<p>b</p>\n"},
+		{"- one\n- two\n\n1. a\n2. b", "<ul>\n<li>one\n</li>\n<li>two\n</li>\n</ul>\n<ol>\n<li>a\n</li>\n<li>b\n</li>\n</ol>\n"},
+		{"3. c\n4. d", "<ol start=\"3\">\n<li>c\n</li>\n<li>d\n</li>\n</ol>\n"},
+		{"- a\n\n- b", "<ul>\n<li><p>a</p>\n</li>\n<li><p>b</p>\n</li>\n</ul>\n"},
+		{"- a\n  - b", "<ul>\n<li>a\n<ul>\n<li>b\n</li>\n</ul>\n</li>\n</ul>\n"},
+		{"- [ ] todo\n- [x] done", "<ul>\n<li><input type=\"checkbox\" disabled/> todo\n</li>\n<li><input type=\"checkbox\" checked disabled/> done\n</li>\n</ul>\n"},
+		{"> quoted\n> > nested", "<blockquote>\n<p>quoted</p>\n<blockquote>\n<p>nested</p>\n</blockquote>\n</blockquote>\n"},
+		{"> quoted\nlazy", "<blockquote>\n<p>quoted\nlazy</p>\n</blockquote>\n"},
+		{"```go\nif a < b {\n```", "<pre><code class=\"language-go\">if a &lt; b {\n</code></pre>\n"},
+		{"    indented <code>", "<pre><code>indented &lt;code&gt;\n</code></pre>\n"},
+		{"| a | b |\n|---|:-:|\n| 1 | 2 |", "<table>\n<thead>\n<tr><th>a</th><th style=\"text-align:center\">b</th></tr>\n</thead>\n<tbody>\n<tr><td>1</td><td style=\"text-align:center\">2</td></tr>\n</tbody>\n</table>\n"},
+	}.check(t, nil)
+}
+
+func TestInline(t *testing.T) {
+	testCases{
+		{"*em* _em_ **strong** __strong__ ***both*** ~~del~~", "<p><em>em</em> <em>em</em> <strong>strong</strong> <strong>strong</strong> <em><strong>both</strong></em> <del>del</del></p>\n"},
+		{"snake_case_name and 2*3*4", "<p>snake_case_name and 2<em>3</em>4</p>\n"},
+		{"a * not em *", "<p>a * not em *</p>\n"},
+		{"`code` `` a`b `` ``unmatched", "<p><code>code</code> <code>a`b</code> ``unmatched</p>\n"},
+		{"`*not em*` \\*escaped\\*", "<p><code>*not em*</code> *escaped*</p>\n"},
+		{"a  \nb\\\nc", "<p>a<br/>\nb<br/>\nc</p>\n"},
+		{"&amp; &copy; & <", "<p>&amp; &copy; &amp; &lt;</p>\n"},
+		{"[link](https://example.com \"Title\")", "<p><a href=\"https://example.com\" title=\"Title\" rel=\"noopener noreferrer\">link</a></p>\n"},
+		{"[*em* link](a.md) [a](<b c.md>) [p](a_(b).md)", "<p><a href=\"a.md\"><em>em</em> link</a> <a href=\"b c.md\">a</a> <a href=\"a_(b).md\">p</a></p>\n"},
+		{"[ref] [text][ref] [Ref][]\n\n[ref]: https://example.com/ref", "<p><a href=\"https://example.com/ref\" rel=\"noopener noreferrer\">ref</a> <a href=\"https://example.com/ref\" rel=\"noopener noreferrer\">text</a> <a href=\"https://example.com/ref\" rel=\"noopener noreferrer\">Ref</a></p>\n"},
+		{"[missing] [a [b] c", "<p>[missing] [a [b] c</p>\n"},
+		{"<https://x.org> <a@b.c> https://bare.org/x).", "<p><a href=\"https://x.org\" rel=\"noopener noreferrer\">https://x.org</a> <a href=\"mailto:a@b.c\">a@b.c</a> <a href=\"https://bare.org/x\" rel=\"noopener noreferrer\">https://bare.org/x</a>).</p>\n"},
+		{"![alt *text*](https://x.org/a.png \"t\")", "<p><img src=\"https://x.org/a.png\" alt=\"alt text\" title=\"t\"/></p>\n"},
+	}.check(t, nil)
+}
+
+func TestSanitizing(t *testing.T) {
+	testCases{
+		// raw HTML is text
+		{"<script>alert(1)</script> <b onclick=x>b</b>", "<p>&lt;script&gt;alert(1)&lt;/script&gt; &lt;b onclick=x&gt;b&lt;/b&gt;</p>\n"},
+		{"<div>\n<img src=x onerror=alert(1)>\n</div>", "<p>&lt;div&gt;\n&lt;img src=x onerror=alert(1)&gt;\n&lt;/div&gt;</p>\n"},
+		{"# <i>h</i>", "<h1 id=\"ihi\">&lt;i&gt;h&lt;/i&gt;</h1>\n"},
+		{"```\"><script>\n```", "<pre><code class=\"language-&#34;&gt;&lt;script&gt;\"></code></pre>\n"},
+		// only the http, https and mailto absolute links are kept
+		{"[x](javascript:alert(1)) [y](JavaScript:alert(1)) [z](data:text/html,x) [w](//evil.org) [m](mailto:a@b.c)", "<p>x y z w <a href=\"mailto:a@b.c\">m</a></p>\n"},
+		{"[x]\n\n[x]: javascript:alert(1)", "<p>x</p>\n"},
+		{"<javascript:alert(1)>", "<p>&lt;javascript:alert(1)&gt;</p>\n"},
+		{"![img](https://x.org/a.png) ![js](javascript:x) ![mail](mailto:a@b.c)", "<p><img src=\"https://x.org/a.png\" alt=\"img\"/> js mail</p>\n"},
+		// the attributes are escaped
+		{"[a\"b](https://x.org/\"onmouseover=\"x 'say \"hi\"')", "<p><a href=\"https://x.org/&#34;onmouseover=&#34;x\" title=\"say &#34;hi&#34;\" rel=\"noopener noreferrer\">a&#34;b</a></p>\n"},
+		{"![a\"><script>](x.png)", "<p><img src=\"x.png\" alt=\"a&#34;&gt;&lt;script&gt;\"/></p>\n"},
+	}.check(t, nil)
+}
+
+func TestResolver(t *testing.T) {
+	resolve := func(destination string, image bool) (string, bool) {
+		if destination == "secret.md" {
+			return "", false
+		}
+		if image {
+			return "/raw/" + destination, true
+		}
+		return "/base/" + destination, true
+	}
+	testCases{
+		{"[a](docs/a.md) [b](secret.md) ![c](img.png)", "<p><a href=\"/base/docs/a.md\">a</a> b <img src=\"/raw/img.png\" alt=\"c\"/></p>\n"},
+		{"[top](#title) [abs](https://x.org)", "<p><a href=\"#title\">top</a> <a href=\"https://x.org\" rel=\"noopener noreferrer\">abs</a></p>\n"},
+	}.check(t, resolve)
+}
+
+// TestNesting checks that the blocks and the inline elements nested
+// deeper than maxNesting are rendered as text.
+func TestNesting(t *testing.T) {
+	depth := maxNesting + 10
+	html := ToHtml(strings.Repeat("> ", depth)+"a", nil)
+	if n := strings.Count(html, "<blockquote>"); n != maxNesting {
+		t.Errorf("%d nested blockquotes, want %d", n, maxNesting)
+	}
+	if !strings.Contains(html, "<p>"+strings.Repeat("&gt; ", depth-maxNesting-1)+"&gt; a</p>") {
+		t.Errorf("the deepest blockquotes are not text: %q", html)
+	}
+	html = ToHtml(strings.Repeat("- ", depth)+"a", nil)
+	if n := strings.Count(html, "<li>"); n != maxNesting {
+		t.Errorf("%d nested list items, want %d", n, maxNesting)
+	}
+	html = ToHtml(strings.Repeat("[", depth)+"a"+strings.Repeat("](b)", depth), nil)
+	if n := strings.Count(html, "<a href="); n != maxNesting {
+		t.Errorf("%d nested links, want %d", n, maxNesting)
+	}
+	if strings.Count(html, "<a ") != strings.Count(html, "</a>") {
+		t.Errorf("unbalanced links: %q", html)
+	}
+}
+
+// TestLinearTime renders sources that would take a time quadratic in
+// their size when the parser scanned the rest of the text from every
+// delimiter, or every nested block.
+func TestLinearTime(t *testing.T) {
+	const size = 256 << 10
+	sources := map[string]string{
+		"brackets":       strings.Repeat("[", size),
+		"nested pairs":   strings.Repeat("[", size/2) + strings.Repeat("]", size/2),
+		"links":          strings.Repeat("[a](x", size/5),
+		"nested links":   strings.Repeat("[a", size/4) + strings.Repeat("](x)", size/8),
+		"references":     "[a]: x\n" + strings.Repeat("[a", size/4) + strings.Repeat("][a]", size/8),
+		"destinations":   "[a](" + strings.Repeat("(", size),
+		"titles":         strings.Repeat("[a](x \"", size/7),
+		"emphasis":       strings.Repeat("*a ", size/3),
+		"underscores":    strings.Repeat("_", size/2) + "a" + strings.Repeat("_", size/2),
+		"backticks":      strings.Repeat("``a", size/3),
+		"blockquotes":    strings.Repeat("> ", size/2),
+		"quoted lists":   strings.Repeat("> - ", size/4),
+		"lists":          strings.Repeat("- ", size/2) + "a",
+		"bare urls":      strings.Repeat("h h ", size/4),
+		"url parens":     "http://a" + strings.Repeat(")", size),
+		"mixed":          strings.Repeat("*[`a](<_", size/8),
+		"autolinks":      strings.Repeat("<", size),
+		"long paragraph": strings.Repeat("a\n", size/2),
+	}
+	for name, source := range sources {
+		start := time.Now()
+		ToHtml(source, nil)
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%s: rendering %d bytes took %v", name, len(source), elapsed)
+		}
+	}
+}
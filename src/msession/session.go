@@ -20,33 +20,75 @@ package msession
 // 675 Mass Ave, Cambridge, MA 02139, USA.
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// defaultSessionExpireTime is the absolute lifetime of a session,
+// counted from its creation; the session also expires after
+// idleTimeout without requests.
 const defaultSessionExpireTime time.Duration = 360 * time.Minute // 6 hours
+const defaultSessionIdleTime time.Duration = 60 * time.Minute
 
 const defaultMapSize int = 32
 const sessionCookieName string = "msessionid"
 
-var sessionRandomNeedsSeed = true
+// cookie attributes and idle timeout, see SetCookieOptions and
+// SetIdleTimeout; they can change while requests are served
+var cookieSecure atomic.Bool
+var cookieSameSite atomic.Int64
+var idleTimeout atomic.Int64
+
+func init() {
+	cookieSameSite.Store(int64(http.SameSiteLaxMode))
+	idleTimeout.Store(int64(defaultSessionIdleTime))
+}
 
 // Session struct contains one real instance of a web Session.
 type Session struct {
 	id             string
-	expiry         time.Time
-	items          map[string]string // TODO: turn this into a sync.Map to avoid concurrency for the same client
+	expiry         time.Time         // absolute expiry
+	lastAccess     time.Time         // for the idle timeout
+	items          map[string]string // private copy, see copyItems
 	responseWriter http.ResponseWriter
 }
 
-// sessions is a private map containing session structs.
-var sessions sync.Map
+// sessions is the private container of session structs.
+var sessions Store = NewMemoryStore()
+
+// storeMutex serializes Save with the deletions of the sessions, so
+// that a request finishing after a logout or a renewal of the id does
+// not store the deleted session again
+var storeMutex sync.Mutex
+
+// SetStore replaces the container of the sessions; call it at startup,
+// before serving any request.
+func SetStore(store Store) {
+	sessions = store
+}
+
+// SetCookieOptions sets the attributes of the session cookie: secure
+// must be true when the server runs over TLS. The cookie is always
+// HttpOnly. It can be called while requests are served.
+func SetCookieOptions(secure bool, sameSite http.SameSite) {
+	cookieSecure.Store(secure)
+	cookieSameSite.Store(int64(sameSite))
+}
+
+// SetIdleTimeout sets the time after which a session without requests
+// expires. It can be called while requests are served.
+func SetIdleTimeout(timeout time.Duration) {
+	idleTimeout.Store(int64(timeout))
+}
 
 // GetSession returns a valid Session object. The servlet client (http
 // handler function) can then call Set() and Get() methods to write and
@@ -64,17 +106,14 @@ func GetSession(w http.ResponseWriter, r *http.Request) Session {
 	} else {
 		// the browser has the cookie
 		stored, found := sessions.Load(readcookie.Value)
-		if !found {
+		if !found || stored.expired() {
 			// the browser has the cookie but it's not in sessions
 			buildNewSession(&s)
 		} else {
 			// the browser has the cookie and it's OK
-			if typedValue, ok := stored.(Session); ok {
-				s = typedValue
-			} else {
-				log.Fatal("Unexpected sync.Map value type!")
-			}
-			s.expiry = time.Now().Add(defaultSessionExpireTime)
+			s = stored
+			s.items = copyItems(stored.items)
+			s.lastAccess = time.Now()
 		}
 	}
 	s.responseWriter = w
@@ -84,7 +123,7 @@ func GetSession(w http.ResponseWriter, r *http.Request) Session {
 // Set writes a key-value pair in session.
 func (s *Session) Set(key string, value string) {
 	if s.id != "" {
-		s.expiry = time.Now().Add(defaultSessionExpireTime)
+		s.lastAccess = time.Now()
 		s.items[key] = value // store the value
 	}
 }
@@ -96,17 +135,29 @@ func (s *Session) Get(key string) string {
 		log.Println("invalid session, use GetSession to get a valid instance")
 		return ""
 	}
-	s.expiry = time.Now().Add(defaultSessionExpireTime)
+	s.lastAccess = time.Now()
 	return s.items[key]
 }
 
 // Save updates the session storage in memory and send/updates
-// the session cookie in the web browser.
+// the session cookie in the web browser. Sessions deleted in the
+// meantime (destroyed, renewed or expired) are not saved.
 func (s *Session) Save() {
 	if s.id != "" {
-		sessions.Store(s.id, *s) // TODO mind about the pointer: is it really useful?
+		storeMutex.Lock()
+		_, found := sessions.Load(s.id)
+		if found {
+			sessions.Store(s.storedCopy())
+		}
+		storeMutex.Unlock()
+		if !found {
+			return
+		}
 		cookie := http.Cookie{Name: sessionCookieName, Value: s.id, Expires: s.expiry}
 		cookie.Path = "/"
+		cookie.HttpOnly = true
+		cookie.Secure = cookieSecure.Load()
+		cookie.SameSite = http.SameSite(cookieSameSite.Load())
 		http.SetCookie(s.responseWriter, &cookie)
 	} else {
 		log.Println("invalid session, use GetSession to get a valid instance")
@@ -120,33 +171,109 @@ func (s *Session) Expirate() {
 	s.expiry = time.Now().Add(-time.Hour)
 }
 
+// RenewId replaces the id of the session, keeping its content; call it
+// when the privileges change (e.g. after a successful login) to prevent
+// session fixation, then call Save() to send the new cookie.
+func (s *Session) RenewId() {
+	if s.id != "" {
+		storeMutex.Lock()
+		sessions.Delete(s.id)
+		s.id = randomSessionId()
+		s.lastAccess = time.Now()
+		sessions.Store(s.storedCopy())
+		storeMutex.Unlock()
+	} else {
+		log.Println("invalid session, use GetSession to get a valid instance")
+	}
+}
+
+// expired returns true if the session reached its absolute expiry
+// or the idle timeout.
+func (s *Session) expired() bool {
+	return s.expiredAfter(time.Duration(idleTimeout.Load()))
+}
+
+// expiredAfter returns true if the session reached its absolute expiry
+// or it had no requests for the given idle time.
+func (s *Session) expiredAfter(idle time.Duration) bool {
+	now := time.Now()
+	return s.expiry.Before(now) || s.lastAccess.Add(idle).Before(now)
+}
+
+// Destroy terminates the session: it is deleted from the server memory
+// and the browser is asked to delete the cookie. After calling Destroy(),
+// do not call Save(), Get() or Set(), because the session is invalid.
+func (s *Session) Destroy() {
+	if s.id != "" {
+		s.Expirate()
+		deleteSession(s.id)
+		cookie := http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1,
+			HttpOnly: true, Secure: cookieSecure.Load(), SameSite: http.SameSite(cookieSameSite.Load())}
+		http.SetCookie(s.responseWriter, &cookie)
+		s.id = ""
+	} else {
+		log.Println("invalid session, use GetSession to get a valid instance")
+	}
+}
+
+// DeleteSessions deletes from the server memory every session having
+// the given value for key (e.g. all the sessions of a username). It
+// returns the number of deleted sessions.
+func DeleteSessions(key string, value string) int {
+	deleted := 0
+	sessions.Range(func(id string, s Session) bool {
+		if s.items[key] == value {
+			deleteSession(id)
+			deleted++
+		}
+		return true
+	})
+	return deleted
+}
+
+// deleteSession deletes a session from sessions, see storeMutex.
+func deleteSession(id string) {
+	storeMutex.Lock()
+	sessions.Delete(id)
+	storeMutex.Unlock()
+}
+
 // buildNewSession creates a new Session and add it to sessions.
 func buildNewSession(s *Session) {
 	// create session attributes
 	s.id = randomSessionId()
-	s.expiry = time.Now().Add(defaultSessionExpireTime)
+	s.lastAccess = time.Now()
+	s.expiry = s.lastAccess.Add(defaultSessionExpireTime)
 	s.items = make(map[string]string, defaultMapSize)
 	// add the session to the container
-	sessions.Store(s.id, *s) // TODO mind about the pointer: is it really useful?
+	sessions.Store(s.storedCopy())
+}
+
+// storedCopy returns a copy of the session to be put in the store.
+// Concurrent requests of the same client work on different Session
+// values: the maps in the store are never modified, each request gets
+// its own copy in GetSession.
+func (s *Session) storedCopy() Session {
+	c := *s
+	c.items = copyItems(s.items)
+	c.responseWriter = nil
+	return c
+}
+
+// copyItems returns a copy of the key-value pairs of a session.
+func copyItems(items map[string]string) map[string]string {
+	c := make(map[string]string, len(items)+defaultMapSize)
+	for k, v := range items {
+		c[k] = v
+	}
+	return c
 }
 
 // sessionGC garbage collects every expired session from sessions.
 func sessionGC() {
-	sessions.Range(func(parK, parV any) bool {
-		var id string
-		var s Session
-		if skey, ok := parK.(string); ok {
-			id = skey
-		} else {
-			log.Fatal("Unexpected sync.Map key type!")
-		}
-		if sval, ok := parV.(Session); ok {
-			s = sval
-		} else {
-			log.Fatal("Unexpected sync.Map value type!")
-		}
-		if s.expiry.Before(time.Now()) {
-			sessions.Delete(id)
+	sessions.Range(func(id string, s Session) bool {
+		if s.expired() {
+			deleteSession(id)
 		}
 		return true
 	})
@@ -157,21 +284,10 @@ func sessionGC() {
 func PrintSessions() string {
 	var info string
 	var activeSessionCount int = 0
-	sessions.Range(func(parK, parV any) bool {
-		var id string
-		var s Session
-		if skey, ok := parK.(string); ok {
-			id = skey
-		} else {
-			log.Fatal("Unexpected sync.Map key type!")
-		}
-		if sval, ok := parV.(Session); ok {
-			s = sval
-		} else {
-			log.Fatal("Unexpected sync.Map value type!")
-		}
+	sessions.Range(func(id string, s Session) bool {
 		info += fmt.Sprintln("\tcookie:", id)
 		info += fmt.Sprintln("\texpiry:", s.expiry.Format("2006-01-02 15:04:05"))
+		info += fmt.Sprintln("\tlast access:", s.lastAccess.Format("2006-01-02 15:04:05"))
 		for k, v := range s.items {
 			info += fmt.Sprintln("\t\tkey:", k, "\n\t\tval:", v)
 		}
@@ -182,22 +298,13 @@ func PrintSessions() string {
 	return "number of sessions: " + strconv.Itoa(activeSessionCount) + "\n" + info
 }
 
-// randomSessionId returns a random hexadeciman string useful
-// as a key for sessions and their cookies-
+// randomSessionId returns a random hexadecimal string useful
+// as a key for sessions and their cookies; it is read from the
+// cryptographically secure random generator.
 func randomSessionId() string {
-	var randomHexString string
-	if sessionRandomNeedsSeed {
-		rand.Seed(time.Now().UnixNano())
-		sessionRandomNeedsSeed = false
-	}
-
-	for i := 0; i < 32; i++ {
-		n := rand.Intn(256)
-		onebyte := fmt.Sprintf("%X", n)
-		if len(onebyte) == 1 {
-			onebyte = "0" + onebyte
-		}
-		randomHexString += onebyte
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		log.Fatal("cannot generate a session id: ", err)
 	}
-	return randomHexString
+	return strings.ToUpper(hex.EncodeToString(buffer))
 }
@@ -0,0 +1,212 @@
+package msession
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newRequest returns a request carrying the cookie of a session.
+func newRequest(id string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if id != "" {
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: id})
+	}
+	return r
+}
+
+// testConcurrentRequests sends parallel requests of the same client,
+// while other clients create, renew and destroy their sessions.
+func testConcurrentRequests(t *testing.T) {
+	s := GetSession(httptest.NewRecorder(), newRequest(""))
+	s.Set("username", "bob")
+	s.Save()
+	id := s.id
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			// the same session from several requests
+			s := GetSession(httptest.NewRecorder(), newRequest(id))
+			if username := s.Get("username"); username != "bob" {
+				t.Errorf("username %q in the session, expected \"bob\"", username)
+			}
+			s.Set("counter", strconv.Itoa(i))
+			s.Save()
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			// another client logs in, out and is logged out by the admin
+			s := GetSession(httptest.NewRecorder(), newRequest(""))
+			s.RenewId()
+			s.Set("username", "user"+strconv.Itoa(i))
+			s.Save()
+			if i%2 == 0 {
+				s.Destroy()
+			} else {
+				DeleteSessions("username", "user"+strconv.Itoa(i))
+			}
+			PrintSessions()
+		}(i)
+	}
+	wg.Wait()
+
+	s = GetSession(httptest.NewRecorder(), newRequest(id))
+	if s.id != id || s.Get("username") != "bob" {
+		t.Errorf("session %q lost after the concurrent requests", id)
+	}
+	if n := DeleteSessions("username", "bob"); n != 1 {
+		t.Errorf("%d sessions of bob deleted, expected 1", n)
+	}
+}
+
+// TestSaveAfterDeletion saves sessions that another request deleted
+// or renamed in the meantime: they must not be stored again.
+func TestSaveAfterDeletion(t *testing.T) {
+	SetStore(NewMemoryStore())
+	deletions := map[string]func(id string){
+		"logout": func(id string) {
+			s := GetSession(httptest.NewRecorder(), newRequest(id))
+			s.Destroy()
+		},
+		"deletion by the administrator": func(id string) {
+			DeleteSessions("username", "bob")
+		},
+		"renewal of the id": func(id string) {
+			s := GetSession(httptest.NewRecorder(), newRequest(id))
+			s.RenewId()
+			s.Save()
+			DeleteSessions("username", "bob")
+		},
+	}
+	for name, deletion := range deletions {
+		s := GetSession(httptest.NewRecorder(), newRequest(""))
+		s.Set("username", "bob")
+		s.Save()
+		// a slow request of the same client
+		slow := GetSession(httptest.NewRecorder(), newRequest(s.id))
+		deletion(s.id)
+		slow.Set("counter", "1")
+		slow.Save()
+		if _, found := sessions.Load(s.id); found {
+			t.Errorf("%s: the session was saved again", name)
+		}
+	}
+}
+
+func TestConcurrentMemorySessions(t *testing.T) {
+	SetStore(NewMemoryStore())
+	testConcurrentRequests(t)
+}
+
+func TestConcurrentFileSessions(t *testing.T) {
+	filename := t.TempDir() + "/sessions.json"
+	store, err := NewFileStore(filename, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetStore(store)
+	defer SetStore(NewMemoryStore())
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := store.Flush(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	testConcurrentRequests(t)
+	wg.Wait()
+
+	// the sessions saved to file are loaded again
+	s := GetSession(httptest.NewRecorder(), newRequest(""))
+	s.Set("username", "alice")
+	s.Save()
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewFileStore(filename, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if saved, found := reloaded.Load(s.id); !found || saved.items["username"] != "alice" {
+		t.Errorf("session %q not found in %s", s.id, filename)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	filename := t.TempDir() + "/sessions.json"
+	store, err := NewFileStore(filename, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetStore(store)
+	defer SetStore(NewMemoryStore())
+
+	// the sessions without data are not written
+	anonymous := GetSession(httptest.NewRecorder(), newRequest(""))
+	anonymous.Save()
+	if store.dirty {
+		t.Error("a session without data changed the file")
+	}
+	s := GetSession(httptest.NewRecorder(), newRequest(""))
+	s.Set("username", "alice")
+	s.Save()
+	// idle for 2 hours, valid with a longer idle timeout
+	idle := GetSession(httptest.NewRecorder(), newRequest(""))
+	idle.Set("username", "bob")
+	idle.lastAccess = time.Now().Add(-2 * time.Hour)
+	store.Store(idle.storedCopy())
+	if err := CloseStore(); err != nil {
+		t.Fatal(err)
+	}
+	if store.dirty {
+		t.Error("the changes were not written when closing the store")
+	}
+
+	for _, timeout := range []time.Duration{time.Hour, 3 * time.Hour} {
+		reloaded, err := NewFileStore(filename, timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reloaded.Close()
+		if _, found := reloaded.Load(anonymous.id); found {
+			t.Error("the session without data was written")
+		}
+		if _, found := reloaded.Load(s.id); !found {
+			t.Errorf("idle timeout %v: session %q not loaded", timeout, s.id)
+		}
+		if _, found := reloaded.Load(idle.id); found != (timeout > 2*time.Hour) {
+			t.Errorf("idle timeout %v: session idle for 2 hours loaded: %v", timeout, found)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package msession
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Store is the container of the sessions. The default one keeps the
+// sessions only in memory; use SetStore at startup to replace it.
+type Store interface {
+	Load(id string) (Session, bool)
+	Store(s Session)
+	Delete(id string)
+	// Range calls f for every session, until f returns false.
+	Range(f func(id string, s Session) bool)
+}
+
+// memoryStore keeps the sessions in memory.
+type memoryStore struct {
+	sessions sync.Map
+}
+
+// NewMemoryStore returns a Store keeping the sessions in memory; they
+// are lost when the server stops.
+func NewMemoryStore() Store {
+	return &memoryStore{}
+}
+
+func (m *memoryStore) Load(id string) (Session, bool) {
+	stored, found := m.sessions.Load(id)
+	if !found {
+		return Session{}, false
+	}
+	s, ok := stored.(Session)
+	if !ok {
+		log.Fatal("Unexpected sync.Map value type!")
+	}
+	return s, true
+}
+
+func (m *memoryStore) Store(s Session) {
+	m.sessions.Store(s.id, s)
+}
+
+func (m *memoryStore) Delete(id string) {
+	m.sessions.Delete(id)
+}
+
+func (m *memoryStore) Range(f func(id string, s Session) bool) {
+	m.sessions.Range(func(parK, parV any) bool {
+		id, ok := parK.(string)
+		if !ok {
+			log.Fatal("Unexpected sync.Map key type!")
+		}
+		s, ok := parV.(Session)
+		if !ok {
+			log.Fatal("Unexpected sync.Map value type!")
+		}
+		return f(id, s)
+	})
+}
+
+// fileStoreFlushInterval is the maximum delay between a change of
+// the sessions and their writing to the file
+const fileStoreFlushInterval time.Duration = 5 * time.Second
+
+// jsonSession is the serialized form of a Session
+type jsonSession struct {
+	Id         string            `json:"id"`
+	Expiry     time.Time         `json:"expiry"`
+	LastAccess time.Time         `json:"last_access"`
+	Items      map[string]string `json:"items"`
+}
+
+// FileStore keeps the sessions in memory and writes them into a file,
+// so that they survive a server restart. Only the sessions holding
+// data are written (e.g. not the ones of the anonymous visitors).
+// Changes are written in the background; call Flush to write them
+// immediately, and Close to stop the background writes.
+type FileStore struct {
+	memoryStore
+	filename  string
+	mutex     sync.Mutex // serializes the writes to the file
+	dirty     bool
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFileStore returns a Store backed by a file; the sessions already
+// contained in the file are loaded, except for the expired ones, which
+// reached their absolute expiry or idleTimeout without requests.
+func NewFileStore(filename string, idleTimeout time.Duration) (*FileStore, error) {
+	f := &FileStore{filename: filename, stop: make(chan struct{})}
+	content, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var saved []jsonSession
+		if err := json.Unmarshal(content, &saved); err != nil {
+			return nil, err
+		}
+		for _, js := range saved {
+			s := Session{id: js.Id, expiry: js.Expiry, lastAccess: js.LastAccess, items: js.Items}
+			if js.Id != "" && !s.expiredAfter(idleTimeout) {
+				if s.items == nil {
+					s.items = make(map[string]string, defaultMapSize)
+				}
+				f.memoryStore.Store(s)
+			}
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(fileStoreFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := f.Flush(); err != nil {
+					log.Println("error while saving the sessions:", err)
+				}
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+	return f, nil
+}
+
+func (f *FileStore) Store(s Session) {
+	f.memoryStore.Store(s)
+	if len(s.items) > 0 {
+		f.setDirty()
+	}
+}
+
+func (f *FileStore) Delete(id string) {
+	deleted, found := f.memoryStore.sessions.LoadAndDelete(id)
+	if s, ok := deleted.(Session); found && ok && len(s.items) > 0 {
+		f.setDirty()
+	}
+}
+
+func (f *FileStore) setDirty() {
+	f.mutex.Lock()
+	f.dirty = true
+	f.mutex.Unlock()
+}
+
+// Flush writes the sessions into the file, if they have been changed.
+func (f *FileStore) Flush() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.dirty {
+		return nil
+	}
+	saved := []jsonSession{}
+	f.memoryStore.Range(func(id string, s Session) bool {
+		if len(s.items) > 0 {
+			saved = append(saved, jsonSession{Id: id, Expiry: s.expiry, LastAccess: s.lastAccess, Items: s.items})
+		}
+		return true
+	})
+	content, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		return err
+	}
+	// write a temporary file and rename it, so that a crash never
+	// leaves a truncated file
+	tmpname := f.filename + ".tmp"
+	if err := os.WriteFile(tmpname, content, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpname, f.filename); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+// Close stops the background writes and writes the pending changes.
+func (f *FileStore) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.stop)
+	})
+	return f.Flush()
+}
+
+// CloseStore closes the store of the sessions, when it keeps them in a
+// file, writing the pending changes; call it before exiting.
+func CloseStore() error {
+	if f, ok := sessions.(*FileStore); ok {
+		return f.Close()
+	}
+	return nil
+}
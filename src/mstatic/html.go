@@ -19,7 +19,14 @@ package mstatic
 // or write to Free Software Foundation, Inc.,
 // 675 Mass Ave, Cambridge, MA 02139, USA.
 
-import "strings"
+import (
+	"html"
+	"strconv"
+	"strings"
+
+	"marcellozaniboni.net/httpiccolo/mdao"
+	"marcellozaniboni.net/httpiccolo/mutils"
+)
 
 func GetHtmlHeader(pageTitle string, small bool, restartNeeded bool, showLoggedUser bool) string {
 	retval := `<!DOCTYPE html>
@@ -39,7 +46,7 @@ func GetHtmlHeader(pageTitle string, small bool, restartNeeded bool, showLoggedU
 	retval += "<div class=\"w3-main\">"
 	if showLoggedUser {
 		retval += `<div align="right">[logged_username] -
-		<a href=".?login=spontaneous" class="w3-hover-text-deep-purple" title="login">change</a></div>`
+		<a href=".?login=spontaneous" class="w3-hover-text-deep-purple" title="login">change</a>[logout_link]</div>`
 	}
 	if restartNeeded {
 		retval += "	<p class='w3-panel w3-red'><b>WARNING</b>: httpiccolo needs a restart <b>now</b> to apply the new settings!</p>"
@@ -61,16 +68,20 @@ func GetHtmlHeader(pageTitle string, small bool, restartNeeded bool, showLoggedU
 
 func GetHtmlUserTable(users map[string]string) string {
 	retval := `<table class='w3-table-all'>
-    <tr><th>username</th><th>actions</th><th>password hash (sha256)</th></tr>`
+    <tr><th>username</th><th>actions</th><th>password hash scheme</th></tr>`
 	//<tr><th width='25%'>username</th><th width='50%'>password (sha256)</th><th width='25%'>actions</th></tr>`
 	for u, p := range users {
 		retval += "\n<tr><td>" + u + "</td>\n<td>"
 		retval += "<a href='javascript:void(0);' onclick='changePassword(\"" + u + "\")'>[change password]</a>&nbsp;\n"
+		retval += "<a href='javascript:void(0);' onclick='logoutUser(\"" + u + "\")'>[logout]</a>&nbsp;\n"
 		retval += "<a href='javascript:void(0);' onclick='deleteUser(\"" + u + "\")'>[delete]</a>&nbsp;&nbsp;\n"
-		retval += "</td>\n<td><small>" + p + "</small></td><td>\n"
-		//	retval += "<img class='w3-hover-yellow' style='cursor: pointer; margin-left:4px; margin-right: 4px; width:22px; height:22px;' alt='change password' title='change password' src='" + imgpencilicon + "' onclick='changePassword(\"" + u + "\")'/>\n"
-		//	retval += "<img class='w3-hover-yellow' style='cursor: pointer; margin-left:4px; margin-right: 4px; width:22px; height:22px;' alt='delete user' title='delete user' src='" + imgtrashicon + "' onclick='deleteUser(\"" + u + "\")'/>\n"
-		retval += "</td></tr>\n"
+		retval += "</td>\n<td><small>"
+		if scheme := mutils.PasswordScheme(p); scheme == mutils.PasswordSchemeArgon2id {
+			retval += scheme
+		} else {
+			retval += "<span class='w3-text-red'>" + scheme + "</span> (upgraded at next login)"
+		}
+		retval += "</small></td></tr>\n"
 	}
 	retval += `<table><p>
 	<!-- old deprecated way
@@ -80,13 +91,37 @@ func GetHtmlUserTable(users map[string]string) string {
 	return retval
 }
 
-func GetHtmlPermissionTable(permissions map[string]string) string {
+func GetHtmlPermissionTable(permissions map[string]string, writePermissions map[string]string) string {
 	retval := `<table class='w3-table-all'>
-    <tr><th width='40%'>directory</th><th width='35%'>allowed user list</th><th width='25%'>actions</th></tr>`
-	for d, u := range permissions {
-		retval += "\n<tr><td>" + d + "</td><td>" + u + "</td><td>\n"
-		//	retval += "<img class='w3-hover-yellow' style='cursor: pointer; margin-left:4px; margin-right: 4px; width:22px; height:22px;' alt='delete permission' title='delete permission' src='" + imgtrashicon + "' onclick='deletePermission(\"" + d + "\")'/>\n"
-		retval += "<a href='javascript:void(0);' onclick='deletePermission(\"" + d + "\")'>[delete]</a>\n"
+    <tr><th width='30%'>directory</th><th width='25%'>allowed user list</th><th width='25%'>write user list</th><th width='20%'>actions</th></tr>`
+	directories := make(map[string]bool, len(permissions)+len(writePermissions))
+	for d := range permissions {
+		directories[d] = true
+	}
+	for d := range writePermissions {
+		directories[d] = true
+	}
+	for d := range directories {
+		u, private := permissions[d]
+		if !private {
+			u = "<i>public</i>"
+		}
+		wu, writable := writePermissions[d]
+		if !writable {
+			wu = "<i>nobody</i>"
+		}
+		if private {
+			u = html.EscapeString(u)
+		}
+		if writable {
+			wu = html.EscapeString(wu)
+		}
+		// the directory names are passed to the scripts in attributes,
+		// like in GetHtmlWriteActions
+		data := " data-path=\"" + html.EscapeString(d) + "\" data-users=\"" + html.EscapeString(permissions[d]) + "\" data-writers=\"" + html.EscapeString(writePermissions[d]) + "\""
+		retval += "\n<tr><td>" + html.EscapeString(d) + "</td><td>" + u + "</td><td>" + wu + "</td><td>\n"
+		retval += "<a href='javascript:void(0);'" + data + " onclick='changeWriteUsers(this.dataset.path, this.dataset.users, this.dataset.writers)'>[change write users]</a>&nbsp;\n"
+		retval += "<a href='javascript:void(0);'" + data + " onclick='deletePermission(this.dataset.path)'>[delete]</a>\n"
 		retval += "</td></tr>"
 	}
 	retval += `</table><p>
@@ -95,6 +130,39 @@ func GetHtmlPermissionTable(permissions map[string]string) string {
 	return retval
 }
 
+func GetHtmlTokenTable(tokens map[string]mdao.JsonToken, users map[string]string) string {
+	retval := `<table class='w3-table-all'>
+    <tr><th width='20%'>username</th><th width='35%'>description</th><th width='25%'>created</th><th width='20%'>actions</th></tr>`
+	for id, t := range tokens {
+		retval += "\n<tr><td>" + t.Username + "</td><td>" + html.EscapeString(t.Description) + "</td><td>" + t.Created + "</td><td>\n"
+		retval += "<a href='javascript:void(0);' onclick='revokeToken(\"" + id + "\")'>[revoke]</a>\n"
+		retval += "</td></tr>"
+	}
+	retval += `</table>
+	<form id="new_token_form" name="new_token_form" action="[new_token_action]" method="post">
+		<input name="csrf_token" type="hidden" value="[csrf_token]"/>
+	<p>
+	<select class="w3-select w3-pale-yellow" style="width:auto" id="new_token_usr" name="new_token_usr">`
+	for u := range users {
+		retval += "\n\t\t<option value=\"" + u + "\">" + u + "</option>"
+	}
+	retval += `
+	</select>
+	<input class="w3-input w3-pale-yellow" style="display:inline; width:auto" id="new_token_description" name="new_token_description" type="text" maxlength="64" placeholder="description (e.g. backup script)"/>
+	<input id="new_token_button" type="submit" value="&nbsp;&nbsp;Create token&nbsp;&nbsp;" class="w3-button w3-border w3-border-blue w3-light-grey"/>
+	</p>
+	</form>`
+	return retval
+}
+
+func GetHtmlNewToken(token string, adminUrl string) string {
+	return `<p>This is the new API token: copy it now, because it will never be shown again.</p>
+<pre class="w3-code">` + token + `</pre>
+<p>Use it in the Authorization header of the requests, for example:</p>
+<pre class="w3-code">curl -H "Authorization: Bearer ` + token + `" https://yourserver/path/file.txt</pre>
+<p><a href="` + adminUrl + `">Go back to the settings</a></p>`
+}
+
 func GetHtmlCounterAfterDaoAction(redirectpath string) string {
 	retval := `
 	<div style="height:80%">
@@ -149,6 +217,41 @@ const HtmlAdminJavascriptAndHiddenForms string = `
 		}
 	}
 
+	function changeWriteUsers(path, userlist, writelist) {
+		var wlist = window.prompt(
+			"Users allowed to write into " + path +
+			"\n(separate multiple users with a comma, leave empty to remove the write grant)",
+			writelist);
+		if (wlist != null) {
+			wlist = wlist.replace(/ /g, "");
+			if (wlist == "" && userlist == "") {
+				alert("Use [delete] to remove the permission.");
+				return;
+			}
+			document.getElementById("change_perm_path").value = path;
+			document.getElementById("change_perm_userlist").value = userlist;
+			document.getElementById("change_perm_writelist").value = wlist;
+			document.getElementById("change_perm_form").submit();
+		}
+	}
+
+	function revokeToken(id) {
+		var confirm = window.confirm("You are going to revoke the API token.\nAre you sure?");
+		if (confirm) {
+			document.getElementById("revoke_token_id").value = id;
+			document.getElementById("revoke_token_form").submit();
+		}
+	}
+
+	function logoutUser(username) {
+		var confirm = window.confirm("You are going to terminate all the sessions of the user " +
+			username + "\nAre you sure?");
+		if (confirm) {
+			document.getElementById("logout_user_usr").value = username;
+			document.getElementById("logout_user_form").submit();
+		}
+	}
+
 	function deletePermission(path) {
 		var confirm = window.confirm("You are going to delete the permisson for " +
 			path + "\nAre you sure?");
@@ -160,19 +263,37 @@ const HtmlAdminJavascriptAndHiddenForms string = `
 
 </script>
 <form id="change_password_form" name="change_password_form" action="[change_password_action]" method="post">
+	<input name="csrf_token" type="hidden" value="[csrf_token]"/>
 	<input id="change_password_usr" name="change_password_usr" type="hidden" value=""/>
 	<input id="change_password_pwd" name="change_password_pwd" type="hidden" value=""/>
 </form>
 <form id="delete_user_form" name="delete_user_form" action="[delete_user_action]" method="post">
+	<input name="csrf_token" type="hidden" value="[csrf_token]"/>
 	<input id="delete_user_usr" name="delete_user_usr" type="hidden" value=""/>
 </form>
+<form id="change_perm_form" name="change_perm_form" action="[change_permusers_action]" method="post">
+	<input name="csrf_token" type="hidden" value="[csrf_token]"/>
+	<input id="change_perm_path" name="change_perm_path" type="hidden" value=""/>
+	<input id="change_perm_userlist" name="change_perm_userlist" type="hidden" value=""/>
+	<input id="change_perm_writelist" name="change_perm_writelist" type="hidden" value=""/>
+</form>
+<form id="logout_user_form" name="logout_user_form" action="[logout_user_action]" method="post">
+	<input name="csrf_token" type="hidden" value="[csrf_token]"/>
+	<input id="logout_user_usr" name="logout_user_usr" type="hidden" value=""/>
+</form>
 <form id="delete_perm_form" name="delete_perm_form" action="[delete_perm_action]" method="post">
+	<input name="csrf_token" type="hidden" value="[csrf_token]"/>
 	<input id="delete_perm_path" name="delete_perm_path" type="hidden" value=""/>
+</form>
+<form id="revoke_token_form" name="revoke_token_form" action="[revoke_token_action]" method="post">
+	<input name="csrf_token" type="hidden" value="[csrf_token]"/>
+	<input id="revoke_token_id" name="revoke_token_id" type="hidden" value=""/>
 </form>`
 
 const HtmlAdminBody string = `
 <h3>General parameters</h3>
 <form id="settings_form" name="settings_form" action="[save_config_action]" method="post">
+<input name="csrf_token" type="hidden" value="[csrf_token]"/>
 <table class='w3-table-all'>
 <tr><th width='20%'>Parameter</th><th width='35%'>Value</th><th width='45%'>Help</th></tr>
 <tr>
@@ -186,9 +307,11 @@ const HtmlAdminBody string = `
 	Example for absolute on Linux (and *nix): <i>/home/user/public/webcontent</i></td>
 </tr>
 <tr>
-    <td [valign]>HTTP port</td>
+    <td [valign]>HTTP(S) port</td>
     <td [valign]><input class="w3-input w3-pale-yellow" id="http_port" name="http_port" type="number" maxlength="5" value="[http_port]" min="20" max="65535"/></td>
-    <td [valign]>HTTP port number (e.g. many people use 8080 or 80).</td>
+    <td [valign]>HTTP port number (e.g. many people use 8080 or 80, or 443 for HTTPS).
+	When it changes, the server moves to the new port and the transfers in progress
+	on the old one are completed.</td>
 </tr>
 <tr>
     <td [valign]>Admin path</td>
@@ -204,6 +327,122 @@ const HtmlAdminBody string = `
     <td [valign]>This is the list of the users that will be able to access this administrator page.
 	Separate multiple users with a comma. Never use spaces!</td>
 </tr>
+<tr>
+    <td [valign]>TLS certificate file</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="tls_cert_file" name="tls_cert_file" type="text" maxlength="256" value="[tls_cert_file]"/></td>
+    <td [valign]>Path of the PEM encoded certificate (or certificate chain) used for HTTPS.
+	Leave this field and the next one empty to serve plain HTTP. A new certificate is used
+	immediately, but switching between HTTP and HTTPS needs a restart, unless the port changes too.<br/>
+	Example: <i>/etc/httpiccolo/cert.pem</i></td>
+</tr>
+<tr>
+    <td [valign]>TLS key file</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="tls_key_file" name="tls_key_file" type="text" maxlength="256" value="[tls_key_file]"/></td>
+    <td [valign]>Path of the PEM encoded private key matching the certificate.</td>
+</tr>
+<tr>
+    <td [valign]>HTTP redirect port</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="http_redirect_port" name="http_redirect_port" type="number" maxlength="5" value="[http_redirect_port]" min="20" max="65535"/></td>
+    <td [valign]>Optional: when HTTPS is enabled, a plain HTTP listener on this port
+	redirects every request to HTTPS (e.g. many people use 80). Leave it empty to disable it.</td>
+</tr>
+<tr>
+    <td [valign]>Session store</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="session_store" name="session_store" type="text" maxlength="6" value="[session_store]"/></td>
+    <td [valign]>Use <i>memory</i> (the default) to keep the login sessions only in memory, or <i>file</i>
+	to save them in the configuration directory, so that users stay logged in when httpiccolo is restarted.
+	Changing it needs a restart.</td>
+</tr>
+<tr>
+    <td [valign]>Session idle timeout</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="session_idle_minutes" name="session_idle_minutes" type="number" maxlength="5" value="[session_idle_minutes]" min="1"/></td>
+    <td [valign]>Minutes without requests after which a user is logged out (default 60). In any
+	case, a login lasts at most 6 hours.</td>
+</tr>
+<tr>
+    <td [valign]>Cookie SameSite</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="cookie_samesite" name="cookie_samesite" type="text" maxlength="6" value="[cookie_samesite]"/></td>
+    <td [valign]>SameSite attribute of the session cookie: <i>lax</i> (the default), <i>strict</i> or <i>none</i>.
+	The cookie is always HttpOnly, and Secure when HTTPS is enabled.</td>
+</tr>
+<tr>
+    <td [valign]>Maximum upload size</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="max_upload_mb" name="max_upload_mb" type="number" maxlength="7" value="[max_upload_mb]" min="1"/></td>
+    <td [valign]>Maximum size in MiB of a single upload request (default 1024).
+	Uploads are allowed only into directories with a write grant (see below).</td>
+</tr>
+<tr>
+    <td [valign]>Maximum archive size</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="archive_max_mb" name="archive_max_mb" type="number" maxlength="7" value="[archive_max_mb]" min="1"/></td>
+    <td [valign]>Maximum total size in MiB of the files in a directory downloaded as a zip or tar.gz
+	archive (default 4096).</td>
+</tr>
+<tr>
+    <td [valign]>Maximum archive files</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="archive_max_files" name="archive_max_files" type="number" maxlength="7" value="[archive_max_files]" min="1"/></td>
+    <td [valign]>Maximum number of files in a downloaded archive (default 10000).</td>
+</tr>
+<tr>
+    <td [valign]>Inline extensions</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="inline_extensions" name="inline_extensions" type="text" maxlength="1024" value="[inline_extensions]"/></td>
+    <td [valign]>Comma separated extensions of the files shown in the browser instead of being downloaded.
+	Leave it empty for the default list: <i>[default_inline_extensions]</i>.
+	The files with other extensions are shown in the browser only if they are images, audio, video,
+	PDF or plain text. The html files shown in the browser are sandboxed: their scripts cannot reach
+	the rest of the site.</td>
+</tr>
+<tr>
+    <td [valign]>Download extensions</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="download_extensions" name="download_extensions" type="text" maxlength="1024" value="[download_extensions]"/></td>
+    <td [valign]>Comma separated extensions of the files that are always downloaded, even if they are
+	in the previous list (e.g. <i>txt,log</i>). In the listings, a small link next to each file gives
+	the other choice.</td>
+</tr>
+<tr>
+    <td [valign]>Show README</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="show_readme" name="show_readme" type="text" maxlength="3" value="[show_readme]"/></td>
+    <td [valign]>Use <i>yes</i> to show the README.md file of a directory, rendered as HTML, under the
+	list of its files; <i>no</i> (the default) to list it like the other files. Markdown files are
+	always rendered when they are opened, with a link to the original file.</td>
+</tr>
+<tr>
+    <td [valign]>Thumbnail directory</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="thumbnail_directory" name="thumbnail_directory" type="text" maxlength="256" value="[thumbnail_directory]"/></td>
+    <td [valign]>Optional: directory where the thumbnails of the gallery view are saved; leave it empty
+	to use the <i>thumbnails</i> subdirectory of the configuration directory. The thumbnails are
+	created again when needed, so the directory can be emptied at any time.</td>
+</tr>
+<tr>
+    <td [valign]>Configuration watch</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="config_watch_seconds" name="config_watch_seconds" type="number" maxlength="5" value="[config_watch_seconds]" min="0"/></td>
+    <td [valign]>Optional: every how many seconds the configuration files are checked; when they are
+	modified by hand, they are reloaded without restarting. Leave it empty or 0 to disable it: the
+	configuration can be reloaded anyway by sending the SIGHUP signal to the process.</td>
+</tr>
+<tr>
+    <td [valign]>Read timeout</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="read_timeout_seconds" name="read_timeout_seconds" type="number" maxlength="6" value="[read_timeout_seconds]" min="0"/></td>
+    <td [valign]>Optional: maximum seconds for reading a whole request, uploads included.
+	Leave it empty or 0 for no limit (the default). Changing it needs a restart, unless the port changes too.</td>
+</tr>
+<tr>
+    <td [valign]>Write timeout</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="write_timeout_seconds" name="write_timeout_seconds" type="number" maxlength="6" value="[write_timeout_seconds]" min="0"/></td>
+    <td [valign]>Optional: maximum seconds for writing a whole response, downloads included.
+	Leave it empty or 0 for no limit (the default). Changing it needs a restart, unless the port changes too.</td>
+</tr>
+<tr>
+    <td [valign]>Idle timeout</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="idle_timeout_seconds" name="idle_timeout_seconds" type="number" maxlength="6" value="[idle_timeout_seconds]" min="0"/></td>
+    <td [valign]>Optional: seconds after which an idle keep-alive connection is closed (default 120).
+	Changing it needs a restart, unless the port changes too.</td>
+</tr>
+<tr>
+    <td [valign]>Shutdown timeout</td>
+    <td [valign]><input class="w3-input w3-pale-yellow" id="shutdown_timeout_seconds" name="shutdown_timeout_seconds" type="number" maxlength="6" value="[shutdown_timeout_seconds]" min="0"/></td>
+    <td [valign]>Optional: when httpiccolo is stopped (SIGTERM or Ctrl+C), the transfers in progress
+	can last up to these seconds (default 30) before being interrupted.</td>
+</tr>
 </table>
 <p>
     <input id="action_button" type="submit" value="&nbsp;&nbsp;Save&nbsp;&nbsp;" class="w3-button w3-border w3-border-blue w3-light-grey"/>
@@ -216,8 +455,291 @@ servers, passwords are chosen by administrators (users cannot change them by the
 [userlist]
 <hr style='height:1px;border-width:0;color:gray;background-color:#E0E0E0'/>
 <h3>Private directories</h3>
-<p>Only logged users can view private directory names. Only the allowed users can explore them.</p>
-[permissionlist]`
+<p>Only logged users can view private directory names. Only the allowed users can explore them.
+Users with a write grant can upload files into a directory and its subdirectories.</p>
+[permissionlist]
+<hr style='height:1px;border-width:0;color:gray;background-color:#E0E0E0'/>
+<h3>API tokens</h3>
+<p>Scripts and API clients (e.g. curl) can authenticate with a token in the header
+<i>Authorization: Bearer &lt;token&gt;</i>, having the same rights of the user the token belongs to.
+Tokens are stored hashed, so they are shown only once, when created.</p>
+[tokenlist]`
+
+// GetHtmlSelectionCheckbox returns the checkbox for selecting a
+// directory item; itempath is the web path of the item.
+func GetHtmlSelectionCheckbox(itempath string) string {
+	return "<input type='checkbox' name='path' value=\"" + html.EscapeString(itempath) + "\" title='select'/>&nbsp;"
+}
+
+// GetHtmlAlternativeFileLink returns the small link placed after the
+// name of a file: "download" for the files shown in the browser,
+// "open" for the files downloaded by default. fileurl must be already
+// URL-escaped (e.g. "/docs/a%3Fb.txt").
+func GetHtmlAlternativeFileLink(fileurl string, inline bool) string {
+	if inline {
+		return "&nbsp;<small><a href=\"" + html.EscapeString(fileurl) + "?download=1\" title='download the file'>[download]</a></small>"
+	}
+	return "&nbsp;<small><a href=\"" + html.EscapeString(fileurl) + "?open=1\" title='open the file in the browser'>[open]</a></small>"
+}
+
+const HtmlRenderedFileLinks string = `<p><small><a href="[directory_url]" title="open the directory">[directory]</a>&nbsp;
+<a href="[raw_url]" title="show the original file">[raw]</a>&nbsp;
+<a href="[download_url]" title="download the original file">[download]</a></small></p>`
+
+const HtmlReadmeTitle string = `<hr style='height:1px;border-width:0;color:gray;background-color:#E0E0E0'/>
+<p><small><i>README.md</i></small></p>`
+
+const HtmlMarkdownBegin string = `<style>
+	.markdown { max-width: 60em; line-height: 1.5 }
+	.markdown h1, .markdown h2 { border-bottom: 1px solid #E0E0E0 }
+	.markdown pre { background-color: #F5F5F5; padding: 8px; overflow-x: auto }
+	.markdown code { background-color: #F5F5F5; padding: 1px 3px }
+	.markdown pre code { padding: 0 }
+	.markdown blockquote { border-left: 4px solid #E0E0E0; margin-left: 0; padding-left: 12px; color: #616161 }
+	.markdown table { border-collapse: collapse }
+	.markdown th, .markdown td { border: 1px solid #E0E0E0; padding: 4px 8px }
+	.markdown img { max-width: 100% }
+</style>
+<div class="markdown">`
+
+const HtmlMarkdownEnd string = "</div>"
+
+const HtmlSourceBegin string = `<style>
+	.source { border-collapse: collapse; font-family: monospace; font-size: 13px; width: 100% }
+	.source td { padding: 0 8px; vertical-align: top }
+	.source td.ln { text-align: right; user-select: none; border-right: 1px solid #E0E0E0; width: 1% }
+	.source td.ln a { color: #9E9E9E; text-decoration: none }
+	.source td.code { white-space: pre-wrap; word-break: break-all }
+	.source tr:target { background-color: #FFF8C5 }
+	.source .kw { color: #A626A4 }
+	.source .lit { color: #0184BC }
+	.source .str { color: #50A14F }
+	.source .com { color: #A0A1A7; font-style: italic }
+	.source .num { color: #986801 }
+</style>
+<table class="source">`
+
+const HtmlSourceEnd string = "</table>"
+
+// GetHtmlSourceLine returns a line of the source viewer; code must be
+// already escaped.
+func GetHtmlSourceLine(number int, code string) string {
+	n := strconv.Itoa(number)
+	return "<tr id=\"L" + n + "\"><td class=\"ln\"><a href=\"#L" + n + "\">" + n + "</a></td><td class=\"code\">" + code + "</td></tr>"
+}
+
+// GetHtmlViewSwitch returns the link for switching between the list
+// and the gallery views of a directory.
+func GetHtmlViewSwitch(directoryurl string, gallery bool) string {
+	if gallery {
+		return "<p><small><a href=\"" + html.EscapeString(directoryurl) + "?view=list\" title='show the files in a table'>[list view]</a></small></p>"
+	}
+	return "<p><small><a href=\"" + html.EscapeString(directoryurl) + "?view=gallery\" title='show the thumbnails of the images'>[gallery view]</a></small></p>"
+}
+
+const HtmlGalleryBegin string = `<style>
+	.gallery { display: flex; flex-wrap: wrap; gap: 12px; margin: 12px 0 }
+	.gallery figure { margin: 0; width: 200px; text-align: center }
+	.gallery .frame { width: 200px; height: 200px; display: flex; align-items: center; justify-content: center; background-color: #F5F5F5 }
+	.gallery img { max-width: 200px; max-height: 200px }
+	.gallery figcaption { font-size: 12px; overflow: hidden; text-overflow: ellipsis; white-space: nowrap }
+	#lightbox { display: none; position: fixed; top: 0; left: 0; width: 100%; height: 100%; background-color: rgba(0,0,0,0.9); z-index: 10 }
+	#lightbox img { position: absolute; top: 0; bottom: 40px; left: 0; right: 0; margin: auto; max-width: 90%; max-height: 85% }
+	#lightbox .caption { position: absolute; bottom: 12px; width: 100%; text-align: center; color: white }
+	#lightbox .button { position: absolute; color: white; font-size: 36px; cursor: pointer; user-select: none; padding: 8px 16px }
+</style>
+<div class="gallery">`
+
+// GetHtmlGalleryItem returns a thumbnail of the gallery; index is the
+// position of the image for the next/previous buttons of the lightbox.
+func GetHtmlGalleryItem(index int, imageurl string, thumbnailurl string, name string) string {
+	return "<figure><a class=\"frame\" href=\"" + html.EscapeString(imageurl) + "\" data-name=\"" + html.EscapeString(name) + "\" onclick=\"return openLightbox(" + strconv.Itoa(index) + ")\">" +
+		"<img src=\"" + html.EscapeString(thumbnailurl) + "\" alt=\"" + html.EscapeString(name) + "\" loading=\"lazy\"/></a>" +
+		"<figcaption title=\"" + html.EscapeString(name) + "\">" + html.EscapeString(name) + "</figcaption></figure>"
+}
+
+const HtmlGalleryEnd string = `</div>
+<div id="lightbox" onclick="if (event.target === this) closeLightbox()">
+	<span class="button" style="top: 8px; right: 8px" onclick="closeLightbox()" title="close (Esc)">&times;</span>
+	<span class="button" style="top: 45%; left: 8px" onclick="showImage(current - 1)" title="previous (left arrow)">&#10094;</span>
+	<span class="button" style="top: 45%; right: 8px" onclick="showImage(current + 1)" title="next (right arrow)">&#10095;</span>
+	<img id="lightbox_image" alt=""/>
+	<div class="caption"><span id="lightbox_caption"></span> - <a id="lightbox_link" style="color: white">open the original</a></div>
+</div>
+<script type="text/javascript" charset="utf-8">
+	var images = document.querySelectorAll(".gallery a.frame");
+	var current = 0;
+	function showImage(index) {
+		current = (index + images.length) % images.length;
+		var link = images[current];
+		document.getElementById("lightbox_image").src = link.href;
+		document.getElementById("lightbox_caption").textContent = link.getAttribute("data-name") + " (" + (current + 1) + "/" + images.length + ")";
+		document.getElementById("lightbox_link").href = link.href;
+	}
+	function openLightbox(index) {
+		showImage(index);
+		document.getElementById("lightbox").style.display = "block";
+		return false;
+	}
+	function closeLightbox() {
+		document.getElementById("lightbox").style.display = "none";
+		document.getElementById("lightbox_image").src = "";
+	}
+	document.addEventListener("keydown", function(event) {
+		if (document.getElementById("lightbox").style.display !== "block") {
+			return;
+		}
+		if (event.key === "Escape") {
+			closeLightbox();
+		} else if (event.key === "ArrowLeft") {
+			showImage(current - 1);
+		} else if (event.key === "ArrowRight") {
+			showImage(current + 1);
+		}
+	});
+</script>`
+
+const HtmlSelectionFormBegin string = `<form id="selection_form" name="selection_form" action="/download_archive" method="post" onsubmit="return checkSelection()">
+<input id="selection_format" name="format" type="hidden" value="zip"/>`
+
+const HtmlSelectionFormEnd string = `<p>
+	<input id="selection_button" type="submit" value="&nbsp;&nbsp;Download selected (zip)&nbsp;&nbsp;" class="w3-button w3-border w3-border-blue w3-light-grey"/>
+</p>
+</form>
+<script type="text/javascript" charset="utf-8">
+	function checkSelection() {
+		var checkboxes = document.getElementsByName("path");
+		for (var i = 0; i < checkboxes.length; i++) {
+			if (checkboxes[i].checked) {
+				return true;
+			}
+		}
+		alert("Select one or more files or directories.");
+		return false;
+	}
+</script>`
+
+const HtmlArchiveLinks string = `<p>Download this directory as an archive:
+<a href="[zip_url]" class="w3-hover-text-deep-purple">[zip]</a>
+<a href="[targz_url]" class="w3-hover-text-deep-purple">[tar.gz]</a></p>`
+
+const HtmlUploadForm string = `
+<hr style='height:1px;border-width:0;color:gray;background-color:#E0E0E0'/>
+<form id="upload_form" name="upload_form" action="[upload_action]" method="post" enctype="multipart/form-data">
+<input name="csrf_token" type="hidden" value="[csrf_token]"/>
+<div id="upload_drop_zone" class="w3-panel w3-border w3-round w3-light-grey w3-padding" style="border-style:dashed!important">
+	<p><b>Upload</b> - drop files here or choose them (maximum total size: [max_upload_size])</p>
+	<p>
+		<input id="overwrite" name="overwrite" type="checkbox"/>
+		<label for="overwrite">overwrite existing files</label>
+	</p>
+	<p>
+		<input id="upload_files" name="upload_files" type="file" multiple/>
+		<input id="upload_button" type="submit" value="&nbsp;&nbsp;Upload&nbsp;&nbsp;" class="w3-button w3-border w3-border-blue w3-light-grey"/>
+	</p>
+</div>
+</form>
+<script type="text/javascript" charset="utf-8">
+	var dropZone = document.getElementById("upload_drop_zone");
+	dropZone.addEventListener("dragover", function(e) {
+		e.preventDefault();
+		dropZone.classList.add("w3-pale-yellow");
+	});
+	dropZone.addEventListener("dragleave", function(e) {
+		dropZone.classList.remove("w3-pale-yellow");
+	});
+	dropZone.addEventListener("drop", function(e) {
+		e.preventDefault();
+		dropZone.classList.remove("w3-pale-yellow");
+		if (e.dataTransfer.files.length > 0) {
+			document.getElementById("upload_files").files = e.dataTransfer.files;
+			document.getElementById("upload_form").submit();
+		}
+	});
+	document.getElementById("upload_form").addEventListener("submit", function() {
+		window.setTimeout(function() {
+			document.getElementById("upload_button").disabled = true;
+		}, 100);
+	});
+</script>`
+
+// GetHtmlWriteActions returns the links for modifying a directory
+// item; itempath is the web path of the item.
+func GetHtmlWriteActions(itempath string, name string) string {
+	data := " data-path=\"" + html.EscapeString(itempath) + "\" data-name=\"" + html.EscapeString(name) + "\""
+	retval := "<small><a href='javascript:void(0);'" + data + " onclick='renameItem(this)'>[rename]</a>&nbsp;\n"
+	retval += "<a href='javascript:void(0);'" + data + " onclick='moveItem(this)'>[move]</a>&nbsp;\n"
+	retval += "<a href='javascript:void(0);'" + data + " onclick='deleteItem(this)'>[delete]</a></small>"
+	return retval
+}
+
+const HtmlWriteActionsJavascriptAndHiddenForms string = `
+<p><input id="mkdir_button" type="button" value="&nbsp;&nbsp;New directory&nbsp;&nbsp;" class="w3-button w3-border w3-border-blue w3-light-grey" onclick="makeDirectory()"/></p>
+<script type="text/javascript" charset="utf-8">
+
+	function makeDirectory() {
+		var name = window.prompt("Name of the new directory:", "");
+		if (name != null && name != "") {
+			document.getElementById("mkdir_name").value = name;
+			document.getElementById("mkdir_form").submit();
+		}
+	}
+
+	function renameItem(link) {
+		var name = window.prompt("Rename " + link.dataset.path + " to:", link.dataset.name);
+		if (name != null && name != "" && name != link.dataset.name) {
+			document.getElementById("rename_path").value = link.dataset.path;
+			document.getElementById("rename_name").value = name;
+			document.getElementById("rename_form").submit();
+		}
+	}
+
+	function moveItem(link) {
+		var currentDirectory = document.getElementById("mkdir_directory").value;
+		var destination = window.prompt("Move " + link.dataset.path +
+			"\ninto the directory (e.g. /public/archive):", currentDirectory);
+		if (destination != null && destination != "" && destination != currentDirectory) {
+			document.getElementById("move_path").value = link.dataset.path;
+			document.getElementById("move_destination").value = destination;
+			document.getElementById("move_form").submit();
+		}
+	}
+
+	function deleteItem(link) {
+		var confirm = window.confirm("You are going to delete " +
+			link.dataset.path + "\nAre you sure?");
+		if (confirm) {
+			document.getElementById("delete_path").value = link.dataset.path;
+			document.getElementById("delete_form").submit();
+		}
+	}
+
+</script>
+<form id="mkdir_form" name="mkdir_form" action="/mkdir_action" method="post">
+	<input name="csrf_token" type="hidden" value="[csrf_token]"/>
+	<input id="mkdir_directory" name="directory" type="hidden" value="[current_directory]"/>
+	<input id="mkdir_name" name="name" type="hidden" value=""/>
+</form>
+<form id="rename_form" name="rename_form" action="/rename_action" method="post">
+	<input name="csrf_token" type="hidden" value="[csrf_token]"/>
+	<input id="rename_path" name="path" type="hidden" value=""/>
+	<input id="rename_name" name="name" type="hidden" value=""/>
+</form>
+<form id="move_form" name="move_form" action="/move_action" method="post">
+	<input name="csrf_token" type="hidden" value="[csrf_token]"/>
+	<input id="move_path" name="path" type="hidden" value=""/>
+	<input id="move_destination" name="destination" type="hidden" value=""/>
+</form>
+<form id="delete_form" name="delete_form" action="/delete_action" method="post">
+	<input name="csrf_token" type="hidden" value="[csrf_token]"/>
+	<input id="delete_path" name="path" type="hidden" value=""/>
+</form>`
+
+const HtmlLogoutLink string = ` -
+		<form action="/logout" method="post" style="display:inline">
+			<input name="csrf_token" type="hidden" value="[csrf_token]"/>
+			<a href="javascript:void(0);" onclick="this.parentNode.submit()" class="w3-hover-text-deep-purple" title="logout">logout</a>
+		</form>`
 
 const HtmlFooter string = "\n\t\t</div>\n\t</body>\n</html>"
 const ErrBannedIP string = "too many failed logins; try again later"
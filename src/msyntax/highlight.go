@@ -0,0 +1,208 @@
+package msyntax
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"html"
+	"strings"
+)
+
+// token classes, used as CSS classes in the HTML
+const (
+	classKeyword  = "kw"
+	classConstant = "lit"
+	classString   = "str"
+	classComment  = "com"
+	classNumber   = "num"
+)
+
+// highlighter writes the HTML of the lines while the source is read
+type highlighter struct {
+	lines   []string
+	current strings.Builder
+}
+
+// emit writes a token; tokens spanning several lines, like block
+// comments, are split so that every line is valid HTML by itself.
+func (h *highlighter) emit(class string, text string) {
+	for {
+		k := strings.IndexByte(text, '\n')
+		piece := text
+		if k >= 0 {
+			piece = text[:k]
+		}
+		if piece != "" {
+			if class != "" {
+				h.current.WriteString("<span class=\"" + class + "\">" + html.EscapeString(piece) + "</span>")
+			} else {
+				h.current.WriteString(html.EscapeString(piece))
+			}
+		}
+		if k < 0 {
+			return
+		}
+		h.lines = append(h.lines, h.current.String())
+		h.current.Reset()
+		text = text[k+1:]
+	}
+}
+
+// Highlight returns the lines of the source as HTML, with the tokens
+// in <span> elements whose classes are kw (keywords), lit (constants),
+// str (strings), com (comments) and num (numbers).
+func Highlight(source string, language *Language) []string {
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	h := &highlighter{}
+	for i := 0; i < len(source); {
+		end, class := language.token(source, i)
+		h.emit(class, source[i:end])
+		i = end
+	}
+	if !strings.HasSuffix(source, "\n") || source == "" {
+		h.lines = append(h.lines, h.current.String())
+	}
+	return h.lines
+}
+
+// token returns the end and the class of the token starting at s[i].
+func (l *Language) token(s string, i int) (int, string) {
+	rest := s[i:]
+	atWordStart := i == 0 || !isWordCharacter(s[i-1], l.dollarWords)
+
+	for _, comment := range l.blockComments {
+		if strings.HasPrefix(rest, comment[0]) {
+			k := strings.Index(rest[len(comment[0]):], comment[1])
+			if k < 0 {
+				return len(s), classComment
+			}
+			return i + len(comment[0]) + k + len(comment[1]), classComment
+		}
+	}
+	for _, comment := range l.lineComments {
+		// "#" starts a comment only after a space, e.g. not in ${#list}
+		if strings.HasPrefix(rest, comment) && (comment != "#" || i == 0 || isSpace(s[i-1])) {
+			return lineEnd(s, i), classComment
+		}
+	}
+	if l.preprocessor && rest[0] == '#' && lineStart(s, i) {
+		j := i + 1
+		for j < len(s) && isWordCharacter(s[j], false) {
+			j++
+		}
+		return j, classKeyword
+	}
+	for _, quote := range l.quotes {
+		if strings.HasPrefix(rest, quote) {
+			return stringEnd(s, i, quote, true), classString
+		}
+	}
+	for _, quote := range l.rawQuotes {
+		if strings.HasPrefix(rest, quote) {
+			return stringEnd(s, i, quote, false), classString
+		}
+	}
+
+	c := rest[0]
+	if c >= '0' && c <= '9' && atWordStart {
+		j := i + 1
+		for j < len(s) && (isWordCharacter(s[j], false) || s[j] == '.' || ((s[j] == '+' || s[j] == '-') && (s[j-1] == 'e' || s[j-1] == 'E') && !strings.HasPrefix(s[i:], "0x"))) {
+			j++
+		}
+		return j, classNumber
+	}
+	if isWordCharacter(c, l.dollarWords) {
+		j := i + 1
+		for j < len(s) && isWordCharacter(s[j], l.dollarWords) {
+			j++
+		}
+		// e.g. "defined?" in Ruby
+		if j < len(s) && s[j] == '?' && l.keywords[s[i:j+1]] {
+			j++
+		}
+		word := s[i:j]
+		switch {
+		case !atWordStart:
+			return j, ""
+		case l.keywords[word]:
+			return j, classKeyword
+		case l.constants[word]:
+			return j, classConstant
+		}
+		return j, ""
+	}
+	// plain text up to the next character that can start a token
+	j := i + 1
+	for j < len(s) && s[j] < 0x80 && !isWordCharacter(s[j], l.dollarWords) && !strings.ContainsRune("\"'`/#-;<*", rune(s[j])) {
+		j++
+	}
+	for j < len(s) && s[j] >= 0x80 {
+		j++
+	}
+	return j, ""
+}
+
+// stringEnd returns the end of the string starting with quote at s[i].
+// Strings with single character quotes end at the end of the line when
+// they are not closed.
+func stringEnd(s string, i int, quote string, escapes bool) int {
+	for j := i + len(quote); j < len(s); j++ {
+		switch {
+		case escapes && s[j] == '\\':
+			j++
+		case strings.HasPrefix(s[j:], quote):
+			return j + len(quote)
+		case s[j] == '\n' && len(quote) == 1 && quote != "`":
+			return j
+		}
+	}
+	return len(s)
+}
+
+// lineEnd returns the position of the end of the line containing s[i].
+func lineEnd(s string, i int) int {
+	if k := strings.IndexByte(s[i:], '\n'); k >= 0 {
+		return i + k
+	}
+	return len(s)
+}
+
+// lineStart returns true when s[i] is the first character of its line,
+// not counting the spaces.
+func lineStart(s string, i int) bool {
+	for j := i - 1; j >= 0; j-- {
+		if s[j] == '\n' {
+			return true
+		}
+		if !isSpace(s[j]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isWordCharacter returns true for the characters of identifiers and
+// numbers, including the bytes of the non ASCII characters.
+func isWordCharacter(c byte, dollar bool) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c >= 0x80 || (dollar && c == '$')
+}
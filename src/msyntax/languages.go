@@ -0,0 +1,210 @@
+package msyntax
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"strings"
+)
+
+// Language describes the syntax of a programming or configuration
+// language, enough for highlighting it.
+type Language struct {
+	Name          string
+	keywords      map[string]bool
+	constants     map[string]bool
+	lineComments  []string    // e.g. "//" or "#"
+	blockComments [][2]string // e.g. "/*" and "*/"
+	quotes        []string    // string delimiters, the longest first
+	rawQuotes     []string    // string delimiters without escapes
+	preprocessor  bool        // #include and the like are keywords
+	dollarWords   bool        // $ can be part of an identifier
+}
+
+// words returns a set of words.
+func words(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(list) {
+		set[w] = true
+	}
+	return set
+}
+
+var cKeywords = "auto break case char const continue default do double else enum extern float for goto if inline int long register restrict return short signed sizeof static struct switch typedef union unsigned void volatile while bool size_t uint8_t uint16_t uint32_t uint64_t int8_t int16_t int32_t int64_t"
+
+var languages = map[string]*Language{
+	"go": {
+		Name:          "Go",
+		keywords:      words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var any bool byte complex64 complex128 error float32 float64 int int8 int16 int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr"),
+		constants:     words("true false nil iota"),
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        []string{"\"", "'"},
+		rawQuotes:     []string{"`"},
+	},
+	"python": {
+		Name:         "Python",
+		keywords:     words("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield self"),
+		constants:    words("True False None"),
+		lineComments: []string{"#"},
+		quotes:       []string{"\"\"\"", "'''", "\"", "'"},
+	},
+	"javascript": {
+		Name:          "JavaScript",
+		keywords:      words("async await break case catch class const continue debugger default delete do else export extends finally for function if import in instanceof let new of return static super switch this throw try typeof var void while with yield interface type enum implements private protected public readonly"),
+		constants:     words("true false null undefined NaN Infinity"),
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        []string{"\"", "'", "`"},
+		dollarWords:   true,
+	},
+	"json": {
+		Name:      "JSON",
+		constants: words("true false null"),
+		quotes:    []string{"\""},
+	},
+	"yaml": {
+		Name:         "YAML",
+		constants:    words("true false null yes no on off True False Null Yes No On Off TRUE FALSE NULL YES NO ON OFF"),
+		lineComments: []string{"#"},
+		quotes:       []string{"\""},
+		rawQuotes:    []string{"'"},
+	},
+	"shell": {
+		Name:         "Shell",
+		keywords:     words("if then else elif fi for while until do done case esac in function return local export readonly declare unset shift exit break continue set source alias echo cd test"),
+		constants:    words("true false"),
+		lineComments: []string{"#"},
+		quotes:       []string{"\""},
+		rawQuotes:    []string{"'"},
+		dollarWords:  true,
+	},
+	"c": {
+		Name:          "C",
+		keywords:      words(cKeywords),
+		constants:     words("NULL true false"),
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        []string{"\"", "'"},
+		preprocessor:  true,
+	},
+	"cpp": {
+		Name:          "C++",
+		keywords:      words(cKeywords + " catch class constexpr delete explicit friend mutable namespace new noexcept operator override private protected public template this throw try typename using virtual auto"),
+		constants:     words("NULL nullptr true false"),
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        []string{"\"", "'"},
+		preprocessor:  true,
+	},
+	"java": {
+		Name:          "Java",
+		keywords:      words("abstract assert boolean break byte case catch char class const continue default do double else enum extends final finally float for goto if implements import instanceof int interface long native new package private protected public return short static strictfp super switch synchronized this throw throws transient try var void volatile while record"),
+		constants:     words("true false null"),
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        []string{"\"\"\"", "\"", "'"},
+	},
+	"rust": {
+		Name:          "Rust",
+		keywords:      words("as async await break const continue crate dyn else enum extern fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait type unsafe use where while i8 i16 i32 i64 i128 isize u8 u16 u32 u64 u128 usize f32 f64 bool char str String"),
+		constants:     words("true false None Some Ok Err"),
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        []string{"\""},
+	},
+	"ruby": {
+		Name:         "Ruby",
+		keywords:     words("alias and begin break case class def defined? do else elsif end ensure for if in module next not or redo rescue retry return self super then undef unless until when while yield require attr_accessor"),
+		constants:    words("true false nil"),
+		lineComments: []string{"#"},
+		quotes:       []string{"\"", "'"},
+	},
+	"sql": {
+		Name:          "SQL",
+		keywords:      words("select from where and or not insert into values update set delete create table drop alter add primary key foreign references index view join inner left right outer on group by order having limit offset as distinct union all case when then else end is in like between exists SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER ADD PRIMARY KEY FOREIGN REFERENCES INDEX VIEW JOIN INNER LEFT RIGHT OUTER ON GROUP BY ORDER HAVING LIMIT OFFSET AS DISTINCT UNION ALL CASE WHEN THEN ELSE END IS IN LIKE BETWEEN EXISTS"),
+		constants:     words("null true false NULL TRUE FALSE"),
+		lineComments:  []string{"--"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        []string{"'", "\""},
+	},
+	"toml": {
+		Name:         "TOML",
+		constants:    words("true false"),
+		lineComments: []string{"#"},
+		quotes:       []string{"\"\"\"", "\""},
+		rawQuotes:    []string{"'''", "'"},
+	},
+	"ini": {
+		Name:         "INI",
+		constants:    words("true false yes no on off"),
+		lineComments: []string{"#", ";"},
+		quotes:       []string{"\""},
+	},
+	"css": {
+		Name:          "CSS",
+		keywords:      words("important media import charset font-face keyframes supports"),
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        []string{"\"", "'"},
+	},
+	"xml": {
+		Name:          "XML",
+		blockComments: [][2]string{{"<!--", "-->"}},
+		quotes:        []string{"\""},
+		rawQuotes:     []string{"'"},
+	},
+}
+
+// extensions maps the file extensions to the languages
+var extensions = map[string]string{
+	"go":   "go",
+	"py":   "python",
+	"js":   "javascript",
+	"mjs":  "javascript",
+	"ts":   "javascript",
+	"json": "json",
+	"yaml": "yaml",
+	"yml":  "yaml",
+	"sh":   "shell",
+	"bash": "shell",
+	"c":    "c",
+	"h":    "c",
+	"cpp":  "cpp",
+	"cc":   "cpp",
+	"hpp":  "cpp",
+	"java": "java",
+	"rs":   "rust",
+	"rb":   "ruby",
+	"sql":  "sql",
+	"toml": "toml",
+	"ini":  "ini",
+	"conf": "ini",
+	"cfg":  "ini",
+	"css":  "css",
+	"xml":  "xml",
+}
+
+// LanguageOf returns the language of a file extension (lower case,
+// without the dot), or nil when it is not source code.
+func LanguageOf(extension string) *Language {
+	if name, found := extensions[extension]; found {
+		return languages[name]
+	}
+	return nil
+}
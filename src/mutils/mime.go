@@ -0,0 +1,118 @@
+package mutils
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// SniffLength is the number of bytes needed by ContentType for
+// detecting the type and the charset of a file
+const SniffLength int = 512
+
+// FileExtension returns the extension of a file name, lower case and
+// without the dot.
+func FileExtension(filename string) string {
+	return strings.TrimPrefix(strings.ToLower(path.Ext(filename)), ".")
+}
+
+// ExtensionContentType returns the MIME type registered for the
+// extension of a file name, without parameters, or an empty string.
+func ExtensionContentType(filename string) string {
+	ext := FileExtension(filename)
+	if ext == "" {
+		return ""
+	}
+	mediatype, _, err := mime.ParseMediaType(mime.TypeByExtension("." + ext))
+	if err != nil {
+		return ""
+	}
+	return mediatype
+}
+
+// ContentType returns the Content-Type of a file: the type comes from
+// the extension or, when it is unknown, from the first bytes of the
+// content (head); for text files the charset is detected from the
+// content as well.
+func ContentType(filename string, head []byte) string {
+	mediatype := ExtensionContentType(filename)
+	if mediatype == "" {
+		mediatype, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+	if !isTextType(mediatype) {
+		return mediatype
+	}
+	charset := textCharset(head)
+	if charset == "" && mediatype != "text/plain" && !strings.HasPrefix(mediatype, "text/x-") {
+		// legacy encodings of html and xml documents are declared
+		// inside them, the browser can read the declaration
+		return mediatype
+	}
+	if charset == "" {
+		charset = "iso-8859-1"
+	}
+	return mediatype + "; charset=" + charset
+}
+
+// isTextType returns true for the MIME types of text files.
+func isTextType(mediatype string) bool {
+	switch mediatype {
+	case "application/json", "application/javascript", "application/xml", "application/xhtml+xml", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediatype, "text/")
+}
+
+// textCharset detects the charset of the first bytes of a text file:
+// a byte order mark, or UTF-8 (ASCII included) when the bytes are valid
+// UTF-8; otherwise it returns an empty string.
+func textCharset(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8"
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	}
+	// the head can end in the middle of a character
+	if utf8.Valid(trimPartialRune(head)) {
+		return "utf-8"
+	}
+	return ""
+}
+
+// trimPartialRune removes an incomplete UTF-8 character at the end of b.
+func trimPartialRune(b []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return b[:len(b)-i]
+			}
+			break
+		}
+	}
+	return b
+}
@@ -0,0 +1,191 @@
+package mutils
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Password hashes are stored in users.json in the PHC string format,
+// e.g. "$argon2id$v=19$m=65536,t=2,p=2$<salt>$<hash>", so that the
+// parameters can be changed in the future without breaking the
+// existing hashes. Old versions stored a bare hex SHA-256: these
+// legacy hashes are still accepted and must be replaced with a new
+// hash after the first successful login.
+
+// argon2id parameters for new hashes
+const (
+	argon2Memory  uint32 = 64 * 1024 // KiB
+	argon2Time    uint32 = 2
+	argon2Threads uint8  = 2
+	argon2SaltLen int    = 16
+	argon2KeyLen  uint32 = 32
+)
+
+// limits of the argon2id parameters of the stored hashes: argon2
+// panics with zero time or threads, and a huge memory could exhaust
+// the memory of the server
+const (
+	argon2MaxMemory  uint32 = 256 * 1024 // KiB
+	argon2MaxTime    uint32 = 16
+	argon2MaxThreads uint8  = 64
+)
+
+const argon2Prefix string = "$argon2id$"
+
+// these are the values returned by PasswordScheme
+const (
+	PasswordSchemeArgon2id string = "argon2id"
+	PasswordSchemeLegacy   string = "legacy SHA-256"
+	PasswordSchemeUnknown  string = "unknown"
+)
+
+// argon2Slots limits the concurrent argon2id computations: each one
+// allocates argon2Memory, so many parallel logins could exhaust the
+// memory of the server.
+var argon2Slots = make(chan struct{}, runtime.NumCPU())
+
+// argon2Key computes an argon2id key, waiting for a free slot.
+func argon2Key(password []byte, salt []byte, time uint32, memory uint32, threads uint8, keyLen uint32) []byte {
+	argon2Slots <- struct{}{}
+	defer func() { <-argon2Slots }()
+	return argon2.IDKey(password, salt, time, memory, threads, keyLen)
+}
+
+// dummyHash is verified when the user does not exist, so that the
+// response time does not reveal which usernames are configured. It is
+// computed at the first use, see getDummyHash.
+var dummyHash string
+var dummyHashOnce sync.Once
+
+// getDummyHash returns dummyHash, computing it the first time.
+func getDummyHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash = HashPassword(RandomId(16))
+	})
+	return dummyHash
+}
+
+// HashPassword returns a salted argon2id hash in PHC string format.
+func HashPassword(password string) string {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		FatalError("fatal error", err)
+	}
+	key := argon2Key([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version,
+		argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+// VerifyPassword compares in constant time a password with a stored
+// hash. The second value returned is true when the password is correct
+// but the hash is legacy or uses old parameters: in this case the
+// caller should store a new hash built with HashPassword.
+func VerifyPassword(password string, storedHash string) (bool, bool) {
+	switch PasswordScheme(storedHash) {
+	case PasswordSchemeArgon2id:
+		var version int
+		var memory, time uint32
+		var threads uint8
+		fields := strings.Split(storedHash, "$")
+		// fields: "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+		if len(fields) != 6 {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false, false
+		}
+		if memory == 0 || memory > argon2MaxMemory || time == 0 || time > argon2MaxTime ||
+			threads == 0 || threads > argon2MaxThreads {
+			return false, false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+		if err != nil {
+			return false, false
+		}
+		expected, err := base64.RawStdEncoding.DecodeString(fields[5])
+		if err != nil || len(expected) == 0 {
+			return false, false
+		}
+		key := argon2Key([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+		if subtle.ConstantTimeCompare(key, expected) != 1 {
+			return false, false
+		}
+		outdated := memory != argon2Memory || time != argon2Time || threads != argon2Threads ||
+			len(salt) != argon2SaltLen || uint32(len(expected)) != argon2KeyLen
+		return true, outdated
+	case PasswordSchemeLegacy:
+		sum := sha256.Sum256([]byte(password))
+		legacy := hex.EncodeToString(sum[:])
+		if subtle.ConstantTimeCompare([]byte(legacy), []byte(strings.ToLower(storedHash))) != 1 {
+			return false, false
+		}
+		return true, true
+	default:
+		// unknown user or broken hash: waste the same time anyway
+		VerifyPassword(password, getDummyHash())
+		return false, false
+	}
+}
+
+// PasswordScheme returns the name of the scheme used by a stored hash.
+func PasswordScheme(storedHash string) string {
+	if strings.HasPrefix(storedHash, argon2Prefix) {
+		return PasswordSchemeArgon2id
+	}
+	if len(storedHash) == sha256.Size*2 {
+		if _, err := hex.DecodeString(storedHash); err == nil {
+			return PasswordSchemeLegacy
+		}
+	}
+	return PasswordSchemeUnknown
+}
+
+// RandomToken returns a random hexadecimal string built from n bytes
+// read from the cryptographically secure random generator.
+func RandomToken(n int) string {
+	buffer := make([]byte, n)
+	if _, err := rand.Read(buffer); err != nil {
+		FatalError("fatal error", err)
+	}
+	return hex.EncodeToString(buffer)
+}
+
+// HashToken returns the hex SHA-256 of an API token. Tokens are long
+// random strings, so a fast hash is enough to store them safely.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
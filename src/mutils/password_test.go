@@ -0,0 +1,56 @@
+package mutils
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import "testing"
+
+func TestVerifyPassword(t *testing.T) {
+	stored := HashPassword("secret")
+	if ok, outdated := VerifyPassword("secret", stored); !ok || outdated {
+		t.Errorf("VerifyPassword of a new hash: %v, %v", ok, outdated)
+	}
+	if ok, _ := VerifyPassword("wrong", stored); ok {
+		t.Error("wrong password accepted")
+	}
+	legacy := "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b" // "secret"
+	if ok, outdated := VerifyPassword("secret", legacy); !ok || !outdated {
+		t.Errorf("VerifyPassword of a legacy hash: %v, %v", ok, outdated)
+	}
+}
+
+// TestVerifyPasswordParameters checks that stored hashes with invalid
+// argon2id parameters are refused, instead of making argon2 panic or
+// allocate a huge memory.
+func TestVerifyPasswordParameters(t *testing.T) {
+	for _, parameters := range []string{
+		"m=65536,t=0,p=2",
+		"m=65536,t=2,p=0",
+		"m=0,t=2,p=2",
+		"m=4294967295,t=2,p=2",
+		"m=65536,t=4294967295,p=2",
+		"m=65536,t=2,p=255",
+		"m=65536,t=2,p=300",
+	} {
+		stored := "$argon2id$v=19$" + parameters + "$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g"
+		if ok, _ := VerifyPassword("secret", stored); ok {
+			t.Errorf("hash with parameters %s accepted", parameters)
+		}
+	}
+}
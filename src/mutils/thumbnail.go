@@ -0,0 +1,125 @@
+package mutils
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // decoders registered for image.Decode
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+)
+
+// maxThumbnailPixels limits the size of the images decoded for making
+// thumbnails, since a decoded image takes 4 or 8 bytes per pixel
+const maxThumbnailPixels int = 50 * 1000 * 1000
+
+// thumbnailSamples is the maximum number of samples per side averaged
+// for each pixel of a thumbnail
+const thumbnailSamples int = 4
+
+// ErrImageTooLarge is returned for images with too many pixels
+var ErrImageTooLarge = errors.New("image too large for a thumbnail")
+
+// MakeThumbnail reads a JPEG, PNG or GIF image and returns a smaller
+// copy whose longest side is at most maxSide pixels; transparent areas
+// become white.
+func MakeThumbnail(resourcepath string, maxSide int) (image.Image, error) {
+	file, err := os.Open(resourcepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxThumbnailPixels {
+		return nil, ErrImageTooLarge
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	return scaleDown(img, maxSide), nil
+}
+
+// scaleDown resizes an image so that its longest side is at most
+// maxSide pixels. Each pixel is the average of up to thumbnailSamples x
+// thumbnailSamples pixels of its area in the original image.
+func scaleDown(img image.Image, maxSide int) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > maxSide || height > maxSide {
+		if width >= height {
+			width, height = maxSide, height*maxSide/width
+		} else {
+			width, height = width*maxSide/height, maxSide
+		}
+		if width < 1 {
+			width = 1
+		}
+		if height < 1 {
+			height = 1
+		}
+	}
+	thumbnail := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			thumbnail.SetRGBA(x, y, averageColor(img, x0, y0, x1, y1))
+		}
+	}
+	return thumbnail
+}
+
+// averageColor returns the average color of an area, over a white
+// background.
+func averageColor(img image.Image, x0 int, y0 int, x1 int, y1 int) color.RGBA {
+	stepX := (x1 - x0 + thumbnailSamples - 1) / thumbnailSamples
+	stepY := (y1 - y0 + thumbnailSamples - 1) / thumbnailSamples
+	if stepX < 1 {
+		stepX = 1
+	}
+	if stepY < 1 {
+		stepY = 1
+	}
+	var r, g, b, n uint64
+	for y := y0; y < y1 || y == y0; y += stepY {
+		for x := x0; x < x1 || x == x0; x += stepX {
+			// the values are premultiplied by alpha
+			cr, cg, cb, ca := img.At(x, y).RGBA()
+			r += uint64(cr + 0xffff - ca)
+			g += uint64(cg + 0xffff - ca)
+			b += uint64(cb + 0xffff - ca)
+			n++
+		}
+	}
+	return color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(b / n >> 8), A: 0xff}
+}
@@ -21,30 +21,20 @@ package mutils
 
 import (
 	"bufio"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const fatalErrorSleep int = 4
 
-var randomNeedsSeed = true
-
-// HashPassword returns a string hash
-func HashPassword(password string) string {
-	hasher := sha256.New()
-	_, err := hasher.Write([]byte(password))
-	if err != nil {
-		FatalError("fatal error", err)
-	}
-	return hex.EncodeToString(hasher.Sum(nil))
-}
+// randomSeed seeds math/rand once, even with concurrent callers
+var randomSeed sync.Once
 
 // FormatFileSize returns pretty-printed file size
 func FormatFileSize(filesize int64) string {
@@ -67,10 +57,9 @@ func FormatFileSize(filesize int64) string {
 
 // RandomId returns a random string
 func RandomId(length int) string {
-	if randomNeedsSeed {
+	randomSeed.Do(func() {
 		rand.Seed(time.Now().UnixNano())
-		randomNeedsSeed = false
-	}
+	})
 	var characters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 	randomRunes := make([]rune, length)
 	for i := 0; i < length; i++ {
@@ -0,0 +1,204 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"marcellozaniboni.net/httpiccolo/mdao"
+	"marcellozaniboni.net/httpiccolo/msession"
+)
+
+// configWatchIdleCheck is how often the watcher checks if it has been
+// enabled, when config_watch_seconds is empty or 0
+const configWatchIdleCheck time.Duration = 10 * time.Second
+
+// configurationFiles are the files reloaded by reloadConfiguration
+var configurationFiles = []string{"params.json", "users.json", "permissions.json", "tokens.json"}
+
+// handleReloadSignal reloads the configuration every time the process
+// receives SIGHUP (e.g. "kill -HUP <pid>" or "systemctl reload").
+func handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Println("SIGHUP received, reloading the configuration")
+		reloadConfiguration(true)
+	}
+}
+
+// watchConfigurationFiles reloads the configuration when the files
+// change on disk; the check interval is config_watch_seconds, and the
+// watch is disabled when it is empty or 0.
+func watchConfigurationFiles() {
+	lastSignature := configurationFilesSignature()
+	for {
+		seconds, _ := strconv.Atoi(state().configuration["config_watch_seconds"])
+		if seconds < 1 {
+			lastSignature = configurationFilesSignature()
+			time.Sleep(configWatchIdleCheck)
+			continue
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+		signature := configurationFilesSignature()
+		if signature != lastSignature {
+			lastSignature = signature
+			reloadConfiguration(false)
+		}
+	}
+}
+
+// configurationFilesSignature returns a string that changes when any
+// configuration file is modified, created or deleted.
+func configurationFilesSignature() string {
+	var signature string
+	for _, name := range configurationFiles {
+		finfo, err := os.Stat(configpath + "/" + name)
+		if err != nil {
+			signature += name + ":-;"
+		} else {
+			signature += fmt.Sprintf("%s:%d:%d;", name, finfo.ModTime().UnixNano(), finfo.Size())
+		}
+	}
+	return signature
+}
+
+// reloadConfiguration reads, validates and applies the configuration
+// files. If something is wrong, the current configuration is kept.
+// The changes are logged; when verbose is false and nothing changed
+// (e.g. the files were just saved by the admin console) nothing is
+// logged.
+func reloadConfiguration(verbose bool) {
+	updateState(func(s *appState) {
+		configuration, err := mdao.LoadGeneralParameters(configpath)
+		if err != nil {
+			log.Println("configuration reload failed, the current configuration is kept:", err)
+			return
+		}
+		users, err := mdao.LoadUsers(configpath)
+		if err != nil {
+			log.Println("configuration reload failed, the current configuration is kept:", err)
+			return
+		}
+		permissions, writePermissions, err := mdao.LoadPermissions(configpath)
+		if err != nil {
+			log.Println("configuration reload failed, the current configuration is kept:", err)
+			return
+		}
+		tokens, err := mdao.LoadTokens(configpath)
+		if err != nil {
+			log.Println("configuration reload failed, the current configuration is kept:", err)
+			return
+		}
+		next := &appState{
+			configuration:    configuration,
+			users:            users,
+			permissions:      permissions,
+			writePermissions: writePermissions,
+			tokens:           tokens,
+		}
+		changes := configurationChanges(s, next)
+		if len(changes) == 0 {
+			if verbose {
+				log.Println("configuration reloaded, nothing changed")
+			}
+			return
+		}
+		restart, err := applyConfiguration(configuration)
+		if err != nil {
+			log.Println("configuration reload failed, the current configuration is kept:", err)
+			return
+		}
+		restartneeded.Store(restart)
+		log.Println("configuration reloaded from " + configpath + ":")
+		for _, change := range changes {
+			log.Println("\t" + change)
+		}
+		if restart {
+			log.Println("configuration reloaded: some settings need a restart")
+		}
+		// the users removed from users.json cannot stay logged in
+		for username := range s.users {
+			if _, found := users[username]; !found {
+				msession.DeleteSessions("username", username)
+			}
+		}
+		*s = *next
+	})
+}
+
+// configurationChanges describes the differences between two states,
+// one line for each change; password hashes are not shown.
+func configurationChanges(current *appState, next *appState) []string {
+	changes := mapChanges("parameter", current.configuration, next.configuration, true)
+	changes = append(changes, mapChanges("user", current.users, next.users, false)...)
+	changes = append(changes, mapChanges("private directory", current.permissions, next.permissions, true)...)
+	changes = append(changes, mapChanges("write permission", current.writePermissions, next.writePermissions, true)...)
+	currentTokens := make(map[string]string, len(current.tokens))
+	for id, t := range current.tokens {
+		currentTokens[id] = t.Username + " " + t.Hash
+	}
+	nextTokens := make(map[string]string, len(next.tokens))
+	for id, t := range next.tokens {
+		nextTokens[id] = t.Username + " " + t.Hash
+	}
+	changes = append(changes, mapChanges("API token", currentTokens, nextTokens, false)...)
+	return changes
+}
+
+// mapChanges describes the differences between two maps in key order;
+// when showValues is false, only the keys are shown.
+func mapChanges(label string, current map[string]string, next map[string]string, showValues bool) []string {
+	var keys []string
+	for k := range current {
+		keys = append(keys, k)
+	}
+	for k := range next {
+		if _, found := current[k]; !found {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var changes []string
+	for _, k := range keys {
+		currentValue, inCurrent := current[k]
+		nextValue, inNext := next[k]
+		switch {
+		case !inNext:
+			changes = append(changes, label+" \""+k+"\" removed")
+		case !inCurrent && showValues:
+			changes = append(changes, label+" \""+k+"\" added: \""+nextValue+"\"")
+		case !inCurrent:
+			changes = append(changes, label+" \""+k+"\" added")
+		case currentValue != nextValue && showValues:
+			changes = append(changes, label+" \""+k+"\" changed: \""+currentValue+"\" -> \""+nextValue+"\"")
+		case currentValue != nextValue:
+			changes = append(changes, label+" \""+k+"\" changed")
+		}
+	}
+	return changes
+}
@@ -0,0 +1,372 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"marcellozaniboni.net/httpiccolo/msession"
+)
+
+// listenerShutdownTimeout is how long a replaced listener keeps
+// serving the active requests (e.g. long downloads) before closing
+const listenerShutdownTimeout time.Duration = 5 * time.Minute
+
+// defaults of the server timeouts, see serverTimeoutsFrom
+const (
+	defaultIdleTimeout     time.Duration = 120 * time.Second
+	defaultShutdownTimeout time.Duration = 30 * time.Second
+	readHeaderTimeout      time.Duration = 30 * time.Second
+)
+
+// serverTimeouts are the timeouts of the http.Server; 0 means no limit.
+type serverTimeouts struct {
+	read  time.Duration
+	write time.Duration
+	idle  time.Duration
+}
+
+// runningServer is an HTTP or HTTPS server listening on a port.
+type runningServer struct {
+	server   *http.Server
+	port     string
+	tls      bool
+	timeouts serverTimeouts
+	// certificate is read at every TLS handshake, so it can be
+	// replaced without rebinding the port
+	certificate atomic.Pointer[tls.Certificate]
+}
+
+// mainServer serves the contents, redirectServer (optional) redirects
+// plain HTTP requests to HTTPS; they are replaced by applyListeners
+var mainServer, redirectServer *runningServer
+
+// serversMutex serializes the changes of the listeners
+var serversMutex sync.Mutex
+
+// drainingServers counts the replaced listeners still serving the
+// active requests
+var drainingServers sync.WaitGroup
+
+// shuttingDown is true when the server is stopping: the listeners
+// cannot be replaced anymore
+var shuttingDown atomic.Bool
+
+// fileSessionsInUse is true when the sessions are saved to file; the
+// session store is chosen at startup and cannot be replaced later
+var fileSessionsInUse bool
+
+// serverTimeoutsFrom reads the timeouts from the configuration. The
+// read and write timeouts have no limit by default, because they
+// include the transfer of the whole body: large uploads and downloads
+// would be interrupted.
+func serverTimeoutsFrom(configuration map[string]string) serverTimeouts {
+	timeouts := serverTimeouts{idle: defaultIdleTimeout}
+	if seconds, err := strconv.Atoi(configuration["read_timeout_seconds"]); err == nil {
+		timeouts.read = time.Duration(seconds) * time.Second
+	}
+	if seconds, err := strconv.Atoi(configuration["write_timeout_seconds"]); err == nil {
+		timeouts.write = time.Duration(seconds) * time.Second
+	}
+	if seconds, err := strconv.Atoi(configuration["idle_timeout_seconds"]); err == nil {
+		timeouts.idle = time.Duration(seconds) * time.Second
+	}
+	return timeouts
+}
+
+// shutdownTimeout returns how long the active requests can last after
+// a shutdown request.
+func shutdownTimeout() time.Duration {
+	if seconds, err := strconv.Atoi(state().configuration["shutdown_timeout_seconds"]); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultShutdownTimeout
+}
+
+// startServer binds the port and serves the requests in background;
+// certificate is nil for plain HTTP. The error is returned immediately
+// if the port cannot be bound.
+func startServer(port string, certificate *tls.Certificate, timeouts serverTimeouts, handler http.Handler) (*runningServer, error) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       timeouts.read,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
+	}
+	rs := &runningServer{server: server, port: port, tls: certificate != nil, timeouts: timeouts}
+	if rs.tls {
+		rs.certificate.Store(certificate)
+		rs.server.TLSConfig = &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return rs.certificate.Load(), nil
+			},
+		}
+	}
+	go func() {
+		var err error
+		if rs.tls {
+			err = rs.server.ServeTLS(listener, "", "")
+		} else {
+			err = rs.server.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	return rs, nil
+}
+
+// stop closes the listener in background; the active requests can
+// complete within listenerShutdownTimeout.
+func (rs *runningServer) stop() {
+	if rs == nil {
+		return
+	}
+	drainingServers.Add(1)
+	go func() {
+		defer drainingServers.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), listenerShutdownTimeout)
+		defer cancel()
+		if err := rs.server.Shutdown(ctx); err != nil {
+			log.Println("listener on port "+rs.port+" closed with active connections:", err)
+			rs.server.Close()
+			return
+		}
+		log.Println("listener on port " + rs.port + " closed")
+	}()
+}
+
+// applyListeners starts, replaces or stops the listeners so that they
+// match the configuration. The new listeners are bound before closing
+// the old ones; if any of them cannot be bound, those already started
+// are closed, the old listeners are kept and the error is returned.
+// The first value returned is true when the change needs a restart:
+// switching between HTTP and HTTPS on the same port.
+func applyListeners(configuration map[string]string) (bool, error) {
+	serversMutex.Lock()
+	defer serversMutex.Unlock()
+	if shuttingDown.Load() {
+		return false, errors.New("the server is shutting down")
+	}
+
+	timeouts := serverTimeoutsFrom(configuration)
+	var certificate *tls.Certificate
+	if configuration["tls_cert_file"] != "" && configuration["tls_key_file"] != "" {
+		loaded, err := tls.LoadX509KeyPair(configuration["tls_cert_file"], configuration["tls_key_file"])
+		if err != nil {
+			return false, err
+		}
+		certificate = &loaded
+	}
+	restart := false
+	port := configuration["http_port"]
+	var newMain *runningServer
+	if mainServer == nil || mainServer.port != port {
+		var err error
+		newMain, err = startServer(port, certificate, timeouts, newServeMux())
+		if err != nil {
+			return false, err
+		}
+	} else if mainServer.tls != (certificate != nil) || mainServer.timeouts != timeouts {
+		// the protocol and the timeouts of a listener cannot change
+		// and the port is busy until the old listener is closed
+		restart = true
+	}
+
+	// the redirect listener follows the protocol really in use
+	mainTls := certificate != nil
+	if newMain == nil {
+		mainTls = mainServer.tls
+	}
+	redirectPort := ""
+	if mainTls {
+		redirectPort = configuration["http_redirect_port"]
+	}
+	currentRedirectPort := ""
+	if redirectServer != nil {
+		currentRedirectPort = redirectServer.port
+	}
+	var newRedirect *runningServer
+	if redirectPort != currentRedirectPort && redirectPort != "" {
+		var err error
+		newRedirect, err = startServer(redirectPort, nil, timeouts, http.HandlerFunc(httpsRedirectHandler))
+		if err != nil {
+			if newMain != nil {
+				// nothing has been served yet
+				newMain.server.Close()
+			}
+			return false, errors.New("cannot start the HTTP redirect listener: " + err.Error())
+		}
+	}
+
+	// every listener is bound: the old ones can be replaced
+	if newMain == nil && mainServer.tls && certificate != nil {
+		// same port, new (or reloaded) certificate
+		mainServer.certificate.Store(certificate)
+	}
+	if newMain != nil {
+		if mainServer != nil {
+			log.Println("moving the server from port " + mainServer.port + " to port " + port)
+		}
+		mainServer.stop()
+		mainServer = newMain
+	}
+	if redirectPort != currentRedirectPort {
+		redirectServer.stop()
+		redirectServer = newRedirect
+		if newRedirect != nil {
+			log.Println("plain HTTP requests are redirected to HTTPS from port " + redirectPort)
+		}
+	}
+	return restart, nil
+}
+
+// applyConfiguration applies a validated configuration to the running
+// server: listeners, TLS certificate and session options. The settings
+// read at every request (root directory, admin path and users, limits)
+// need nothing else. The first value returned is true when some
+// settings need a restart to take effect.
+func applyConfiguration(configuration map[string]string) (bool, error) {
+	restart, err := applyListeners(configuration)
+	if err != nil {
+		return false, err
+	}
+	sameSite := http.SameSiteLaxMode
+	switch configuration["cookie_samesite"] {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+	msession.SetCookieOptions(tlsEnabled(), sameSite)
+	msession.SetIdleTimeout(sessionIdleTimeout(configuration))
+	if (configuration["session_store"] == "file") != fileSessionsInUse {
+		restart = true
+	}
+	return restart, nil
+}
+
+// sessionIdleTimeout returns the configured time after which a session
+// without requests expires.
+func sessionIdleTimeout(configuration map[string]string) time.Duration {
+	idleMinutes, err := strconv.Atoi(configuration["session_idle_minutes"])
+	if err != nil {
+		idleMinutes = 60
+	}
+	return time.Duration(idleMinutes) * time.Minute
+}
+
+// tlsEnabled returns true when the server is running in HTTPS mode.
+func tlsEnabled() bool {
+	serversMutex.Lock()
+	defer serversMutex.Unlock()
+	return mainServer != nil && mainServer.tls
+}
+
+// serverUrl returns the base URL of the server as reached by the
+// client, but with the port currently in use (e.g. "https://host:8443").
+func serverUrl(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// the Host header has no port
+		host = strings.Trim(r.Host, "[]")
+	}
+	scheme := "http"
+	if tlsEnabled() {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, state().configuration["http_port"])
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT is received, then
+// stops the server: the listeners are closed, the active requests
+// (e.g. downloads) can complete within shutdown_timeout_seconds, the
+// pending configuration and session writes are completed, and the
+// process exits. A second signal stops the process immediately.
+func waitForShutdown() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	received := <-signals
+	shuttingDown.Store(true)
+	timeout := shutdownTimeout()
+	log.Println("signal \"" + received.String() + "\" received, shutting down; active requests can complete within " + timeout.String())
+	go func() {
+		<-signals
+		log.Println("second signal received, exiting immediately")
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	serversMutex.Lock()
+	running := []*runningServer{mainServer, redirectServer}
+	serversMutex.Unlock()
+	var wg sync.WaitGroup
+	for _, rs := range running {
+		if rs == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(rs *runningServer) {
+			defer wg.Done()
+			if err := rs.server.Shutdown(ctx); err != nil {
+				log.Println("port " + rs.port + ": requests still active at the deadline, closing them")
+				rs.server.Close()
+			}
+		}(rs)
+	}
+	wg.Wait()
+	// the listeners replaced by a port change can be still draining
+	drained := make(chan struct{})
+	go func() {
+		drainingServers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+
+	// wait for the configuration files being written, if any
+	stateWriteMutex.Lock()
+	if err := msession.CloseStore(); err != nil {
+		log.Println("error while saving the sessions:", err)
+	}
+	log.Println("httpiccolo stopped")
+	os.Exit(0)
+}
@@ -0,0 +1,97 @@
+package main
+
+// httpiccolo
+//
+// Copyright © 2022 Marcello Zaniboni
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public
+// License along with this program; if not, you can visit
+// https://www.gnu.org/licenses/
+// or write to Free Software Foundation, Inc.,
+// 675 Mass Ave, Cambridge, MA 02139, USA.
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"marcellozaniboni.net/httpiccolo/mdao"
+)
+
+// appState is a snapshot of the configuration, the users, the
+// permissions and the API tokens. Requests are served concurrently,
+// so a published snapshot is never modified: readers get the current
+// one with state(), writers build a modified copy with updateState().
+type appState struct {
+	// configuration contains the main configuration
+	configuration map[string]string
+	// users contains a username-password map for configured users
+	users map[string]string
+	// permissions contains a directory-userlist map for restricted access control
+	permissions map[string]string
+	// writePermissions contains a directory-userlist map of the users
+	// allowed to upload and modify contents
+	writePermissions map[string]string
+	// tokens contains the API tokens, indexed by their id
+	tokens map[string]mdao.JsonToken
+}
+
+// currentState is the last published snapshot
+var currentState atomic.Pointer[appState]
+
+// stateWriteMutex serializes the writers, so that no update is lost
+var stateWriteMutex sync.Mutex
+
+// state returns the current snapshot; it must be used only for
+// reading. Call it once per request when several values must be
+// consistent with each other.
+func state() *appState {
+	return currentState.Load()
+}
+
+// setState publishes a new snapshot, e.g. at startup.
+func setState(s *appState) {
+	currentState.Store(s)
+}
+
+// updateState calls update on a copy of the current snapshot and then
+// publishes the copy. The writers are serialized, so update can also
+// save the modified maps into the configuration files.
+func updateState(update func(s *appState)) {
+	stateWriteMutex.Lock()
+	defer stateWriteMutex.Unlock()
+	next := state().clone()
+	update(next)
+	setState(next)
+}
+
+// clone returns a deep copy of a snapshot.
+func (s *appState) clone() *appState {
+	c := &appState{
+		configuration:    cloneStringMap(s.configuration),
+		users:            cloneStringMap(s.users),
+		permissions:      cloneStringMap(s.permissions),
+		writePermissions: cloneStringMap(s.writePermissions),
+		tokens:           make(map[string]mdao.JsonToken, len(s.tokens)),
+	}
+	for k, v := range s.tokens {
+		c.tokens[k] = v
+	}
+	return c
+}
+
+func cloneStringMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}